@@ -0,0 +1,367 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"cmp"
+	"compress/flate"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// downloadAndConvertArchive Rewrites the zip archive of a multi asset download: entries with a download task are replaced by their conversion, other entries are copied as is.
+// The archive is read entry by entry as it's downloaded and the rewritten archive is streamed to the client, only the entry being converted is written to disk
+func downloadAndConvertArchive(w http.ResponseWriter, r *http.Request, logger *customLogger) (err error) {
+	logger.SetErrPrefix("download and convert archive")
+	var body []byte
+	if body, err = io.ReadAll(r.Body); logger.Error(err, "read body") {
+		return
+	}
+	// The request can still be proxied as is until something is written to the client
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	var req *http.Request
+	var resp *http.Response
+	if req, err = http.NewRequest("POST", upstreamURL+r.URL.String(), bytes.NewReader(body)); logger.Error(err, "new POST") {
+		return
+	}
+	req.Header = r.Header.Clone()
+	req.Header.Del("Accept-Encoding")
+	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		setHeaders(w.Header(), resp.Header)
+		w.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(w, resp.Body)
+		return nil
+	}
+	zipReader := newZipStreamReader(resp.Body)
+	var entry *zip.FileHeader
+	var entryBody io.Reader
+	if entry, entryBody, err = zipReader.Next(); err != nil && !errors.Is(err, io.EOF) {
+		logger.Error(err, "zip open")
+		return
+	}
+
+	setHeaders(w.Header(), resp.Header)
+	w.Header().Del("Content-Length")
+	w.WriteHeader(resp.StatusCode)
+	zipWriter := zip.NewWriter(w)
+	converted, entries := 0, 0
+	for ; err == nil; entry, entryBody, err = zipReader.Next() {
+		entries++
+		ok, err := convertArchiveEntry(zipWriter, entry, entryBody, r.Header, logger)
+		if err != nil {
+			// Headers are already sent, the client gets a truncated archive
+			logger.Error(err, entry.Name)
+			return nil
+		}
+		if ok {
+			converted++
+		}
+	}
+	if !errors.Is(err, io.EOF) {
+		logger.Error(err, "zip read")
+		return nil
+	}
+	if err = zipWriter.Close(); logger.Error(err, "zip close") {
+		return nil
+	}
+	logger.Printf("archive rewritten: %d/%d files converted", converted, entries)
+	return nil
+}
+
+// convertArchiveEntry Writes the converted entry if it has a download task and the client doesn't support it, the original entry otherwise
+func convertArchiveEntry(zipWriter *zip.Writer, entry *zip.FileHeader, body io.Reader, header http.Header, logger *customLogger) (bool, error) {
+	mimeType := mimeTypeByExtension(path.Ext(entry.Name))
+	downloadTask := findDownloadTask(mimeType)
+	if downloadTask == nil || strings.HasSuffix(entry.Name, "/") {
+		return false, copyArchiveEntry(zipWriter, entry, body)
+	}
+	format, convert := negotiateFormat(header, mimeType, downloadTask)
+	if !convert {
+		return false, copyArchiveEntry(zipWriter, entry, body)
+	}
+	blob, err := os.CreateTemp("", "blob-*")
+	if err != nil {
+		return false, err
+	}
+	defer func() { blob.Close(); _ = os.Remove(blob.Name()) }()
+	// The entry checksum is the stored file checksum, so the download cache is shared with single downloads
+	hasher := sha1.New()
+	if _, err = io.Copy(blob, io.TeeReader(body, hasher)); err != nil {
+		return false, fmt.Errorf("extract: %w", err)
+	}
+	converted, release, err := convertLocalFile(blob.Name(), encodeChecksum(hasher), mimeType, downloadTask, format, logger)
+	if err != nil {
+		logger.Error(err, "convert "+entry.Name)
+		if _, err = blob.Seek(0, io.SeekStart); err != nil {
+			return false, err
+		}
+		return false, copyArchiveEntry(zipWriter, entry, blob)
+	}
+	defer release()
+	// Same name toOriginalAsset advertises, images are already compressed
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     entry.Name + imageFormats[format].Extension,
+		Method:   zip.Store,
+		Modified: entry.Modified,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = io.Copy(writer, converted)
+	return true, err
+}
+
+// copyArchiveEntry Writes the entry content with the same name, compression method and modification time
+func copyArchiveEntry(zipWriter *zip.Writer, entry *zip.FileHeader, body io.Reader) error {
+	writer, err := zipWriter.CreateHeader(&zip.FileHeader{
+		Name:     entry.Name,
+		Method:   entry.Method,
+		Modified: entry.Modified,
+	})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(writer, body)
+	return err
+}
+
+const (
+	zipLocalHeaderSignature      = 0x04034b50
+	zipDataDescriptorSignature   = 0x08074b50
+	zipCentralDirectorySignature = 0x02014b50
+	zipEndSignature              = 0x06054b50
+)
+
+// zipStreamReader Reads the entries of a zip archive in order from their local headers, without seeking to the central directory.
+// Entries written by streaming zip writers, like the immich one, have a data descriptor after the data instead of sizes in the header:
+// the end of deflated entries is found by the decompressor, the end of stored entries by a descriptor matching the data read
+type zipStreamReader struct {
+	reader *bufio.Reader
+	body   io.Reader
+}
+
+func newZipStreamReader(reader io.Reader) *zipStreamReader {
+	return &zipStreamReader{reader: bufio.NewReaderSize(reader, 64<<10)}
+}
+
+// Next Skips the rest of the current entry and returns the next one, io.EOF once the central directory is reached
+func (z *zipStreamReader) Next() (*zip.FileHeader, io.Reader, error) {
+	if z.body != nil {
+		if _, err := io.Copy(io.Discard, z.body); err != nil {
+			return nil, nil, err
+		}
+		z.body = nil
+	}
+	// signature(4) version(2) flags(2) method(2) time(2) date(2) crc32(4) compressed(4) uncompressed(4) name length(2) extra length(2)
+	header := make([]byte, 30)
+	if _, err := io.ReadFull(z.reader, header[:4]); err != nil {
+		return nil, nil, err
+	}
+	switch binary.LittleEndian.Uint32(header) {
+	case zipLocalHeaderSignature:
+	case zipCentralDirectorySignature, zipEndSignature:
+		return nil, nil, io.EOF
+	default:
+		return nil, nil, zip.ErrFormat
+	}
+	if _, err := io.ReadFull(z.reader, header[4:]); err != nil {
+		return nil, nil, err
+	}
+	flags := binary.LittleEndian.Uint16(header[6:])
+	entry := &zip.FileHeader{
+		Method:             binary.LittleEndian.Uint16(header[8:]),
+		Modified:           msDosTime(binary.LittleEndian.Uint16(header[12:]), binary.LittleEndian.Uint16(header[10:])),
+		CompressedSize64:   uint64(binary.LittleEndian.Uint32(header[18:])),
+		UncompressedSize64: uint64(binary.LittleEndian.Uint32(header[22:])),
+	}
+	nameExtra := make([]byte, int(binary.LittleEndian.Uint16(header[26:]))+int(binary.LittleEndian.Uint16(header[28:])))
+	if _, err := io.ReadFull(z.reader, nameExtra); err != nil {
+		return nil, nil, err
+	}
+	nameLength := binary.LittleEndian.Uint16(header[26:])
+	entry.Name = string(nameExtra[:nameLength])
+	// Zip64 extended information: sizes of 0xFFFFFFFF in the header are in the extra field
+	for extra := nameExtra[nameLength:]; len(extra) >= 4; {
+		id, size := binary.LittleEndian.Uint16(extra), int(binary.LittleEndian.Uint16(extra[2:]))
+		if len(extra) < 4+size {
+			break
+		}
+		if field := extra[4 : 4+size]; id == 0x0001 && len(field) >= 16 {
+			entry.UncompressedSize64 = binary.LittleEndian.Uint64(field)
+			entry.CompressedSize64 = binary.LittleEndian.Uint64(field[8:])
+		}
+		extra = extra[4+size:]
+	}
+	if entry.Method != zip.Store && entry.Method != zip.Deflate {
+		return nil, nil, fmt.Errorf("%s: %w", entry.Name, zip.ErrAlgorithm)
+	}
+
+	hasDataDescriptor := flags&0x8 != 0
+	switch {
+	case !hasDataDescriptor:
+		z.body = io.LimitReader(z.reader, int64(entry.CompressedSize64))
+		if entry.Method == zip.Deflate {
+			z.body = &zipDeflatedBody{reader: flate.NewReader(z.body)}
+		}
+	case entry.Method == zip.Deflate:
+		compressed := &countingByteReader{reader: z.reader}
+		z.body = &zipDeflatedBody{reader: flate.NewReader(compressed), descriptor: func() error {
+			return z.readDataDescriptor(compressed.count)
+		}}
+	default:
+		z.body = &zipStoredBody{reader: z.reader, crc: crc32.NewIEEE()}
+	}
+	return entry, z.body, nil
+}
+
+// readDataDescriptor Skips the data descriptor following a deflated entry: [signature(4)] crc32(4) compressed(4|8) uncompressed(4|8).
+// Sizes are 8 bytes for zip64 entries, found by matching the compressed size read
+func (z *zipStreamReader) readDataDescriptor(compressed uint64) error {
+	if peek, err := z.reader.Peek(4); err == nil && binary.LittleEndian.Uint32(peek) == zipDataDescriptorSignature {
+		_, _ = z.reader.Discard(4)
+	}
+	peek, err := z.reader.Peek(12)
+	if err != nil {
+		return fmt.Errorf("data descriptor: %w", err)
+	}
+	if uint64(binary.LittleEndian.Uint32(peek[4:])) == compressed {
+		_, err = z.reader.Discard(12)
+		return err
+	}
+	if peek, err = z.reader.Peek(20); err != nil || binary.LittleEndian.Uint64(peek[4:]) != compressed {
+		return errors.New("data descriptor: compressed size mismatch")
+	}
+	_, err = z.reader.Discard(20)
+	return err
+}
+
+// zipDeflatedBody Decompresses an entry, the data descriptor is read once the compressed data ends
+type zipDeflatedBody struct {
+	reader     io.ReadCloser
+	descriptor func() error
+}
+
+func (b *zipDeflatedBody) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	if errors.Is(err, io.EOF) && b.descriptor != nil {
+		if err = b.descriptor(); err == nil {
+			err = io.EOF
+		}
+		b.descriptor = nil
+	}
+	return n, err
+}
+
+// zipStoredBody Reads a stored entry of unknown size: it ends at the data descriptor whose signature, crc32 and sizes match the data read so far
+type zipStoredBody struct {
+	reader *bufio.Reader
+	crc    hash.Hash32
+	size   uint64
+	done   bool
+}
+
+func (b *zipStoredBody) Read(p []byte) (int, error) {
+	if b.done {
+		return 0, io.EOF
+	}
+	for {
+		// Errors are only final once the buffered data is consumed
+		peek, err := b.reader.Peek(b.reader.Size())
+		if len(peek) == 0 {
+			if err == nil || errors.Is(err, io.EOF) {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		signature := []byte{0x50, 0x4b, 0x07, 0x08}
+		i := bytes.Index(peek, signature)
+		switch {
+		case i > 0:
+			return b.consume(p, i)
+		case i == -1 && len(peek) > len(signature)-1:
+			// The end of the buffer may be the beginning of a signature
+			return b.consume(p, len(peek)-len(signature)+1)
+		case i == -1:
+			return 0, io.ErrUnexpectedEOF
+		}
+		if b.matchDataDescriptor(peek, 4) {
+			b.done = true
+			_, err = b.reader.Discard(16)
+			return 0, cmp.Or(err, io.EOF)
+		}
+		if b.matchDataDescriptor(peek, 8) {
+			b.done = true
+			_, err = b.reader.Discard(24)
+			return 0, cmp.Or(err, io.EOF)
+		}
+		// The data contains the signature
+		return b.consume(p, 1)
+	}
+}
+
+// matchDataDescriptor Reports whether the buffer starts with the descriptor of the data read so far, sizes of sizeLength bytes
+func (b *zipStoredBody) matchDataDescriptor(peek []byte, sizeLength int) bool {
+	if len(peek) < 8+2*sizeLength || binary.LittleEndian.Uint32(peek[4:]) != b.crc.Sum32() {
+		return false
+	}
+	for _, size := range []int{8, 8 + sizeLength} {
+		var value uint64
+		if sizeLength == 4 {
+			value = uint64(binary.LittleEndian.Uint32(peek[size:]))
+		} else {
+			value = binary.LittleEndian.Uint64(peek[size:])
+		}
+		if value != b.size {
+			return false
+		}
+	}
+	return true
+}
+
+// consume Returns up to n buffered bytes
+func (b *zipStoredBody) consume(p []byte, n int) (int, error) {
+	n, _ = b.reader.Read(p[:min(n, len(p))])
+	b.crc.Write(p[:n])
+	b.size += uint64(n)
+	return n, nil
+}
+
+// countingByteReader Counts the compressed bytes read by the decompressor, which reads byte by byte without going past the compressed data
+type countingByteReader struct {
+	reader *bufio.Reader
+	count  uint64
+}
+
+func (c *countingByteReader) Read(p []byte) (int, error) {
+	n, err := c.reader.Read(p)
+	c.count += uint64(n)
+	return n, err
+}
+
+func (c *countingByteReader) ReadByte() (byte, error) {
+	b, err := c.reader.ReadByte()
+	if err == nil {
+		c.count++
+	}
+	return b, err
+}
+
+// msDosTime Converts the MS-DOS date and time of a zip header, in UTC like archive/zip
+func msDosTime(dosDate, dosTime uint16) time.Time {
+	return time.Date(int(dosDate>>9)+1980, time.Month(dosDate>>5&0xf), int(dosDate&0x1f), int(dosTime>>11), int(dosTime>>5&0x3f), int(dosTime&0x1f)*2, 0, time.UTC)
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"time"
+)
+
+// backfillStats Totals of a backfill. Candidate sizes come from the EXIF info, measuredSize is the part of them already processed
+type backfillStats struct {
+	candidates     int
+	candidatesSize int64
+	processed      int
+	replaced       int
+	failed         int
+	originalsSize  int64
+	processedSize  int64
+	measuredSize   int64
+}
+
+// runBackfill Processes the assets uploaded before IUO with the tasks, as if they were uploaded through the proxy.
+// Smaller files replace the stored ones and the checksums are recorded so clients still see the originals.
+// Processed assets are recorded in the state file, a backfill can be interrupted and run again
+func runBackfill(args []string) error {
+	flags := flag.NewFlagSet("backfill", flag.ContinueOnError)
+	dryRun := flags.Bool("dry_run", false, "Process the assets without replacing them and estimate the savings")
+	filter := flags.String("users", "", "Comma separated emails or ids of the users to backfill. Default: all the -api_key users")
+	statePath := flags.String("state", "", "File recording the processed assets, to resume an interrupted backfill. Default: <checksums_file>.backfill")
+	interval := flags.Duration("interval", time.Second, "Minimum time between two processed assets, limits the load on immich")
+	limit := flags.Int("limit", 0, "Number of assets to process before stopping, 0 for all. A dry run estimates the savings of all the assets from the processed ones")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	var err error
+	if config, err = NewConfig(&configFile); err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	users, err := initCommand()
+	if err != nil {
+		return err
+	}
+	if vaultLocation != "" && !*dryRun {
+		if vault, err = newVault(vaultLocation); err != nil {
+			return fmt.Errorf("vault: %w", err)
+		}
+	}
+	if *statePath == "" {
+		*statePath = checksumsFile + ".backfill"
+	}
+	state, err := readCommandState(*statePath)
+	if err != nil {
+		return err
+	}
+	stateFile, err := os.OpenFile(*statePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer stateFile.Close()
+
+	var stats backfillStats
+	var last time.Time
+	for _, user := range selectUsers(users, *filter) {
+		logger := newCustomLogger(baseLogger, user.Email+": ")
+		for page := 1; page > 0; {
+			var assets []Asset
+			if assets, page, err = searchAssetsPage(user.Header, nil, page, 250); err != nil {
+				return fmt.Errorf("%s: unable to list assets: %w", user.Email, err)
+			}
+			for _, asset := range assets {
+				task, size := backfillTask(asset)
+				if task == nil || state[user.ID+" "+fmt.Sprint(asset["id"])] {
+					continue
+				}
+				stats.candidates++
+				stats.candidatesSize += size
+				if *limit > 0 && stats.processed >= *limit {
+					continue
+				}
+				// Rate limit
+				time.Sleep(time.Until(last.Add(*interval)))
+				last = time.Now()
+				stats.processed++
+				measured := stats.originalsSize
+				replaced, err := backfillAsset(user, asset, task, *dryRun, logger, &stats)
+				if stats.originalsSize != measured {
+					stats.measuredSize += size
+				}
+				if err != nil {
+					logger.Printf("%s (%s): %v", asset["originalFileName"], asset["id"], err)
+					stats.failed++
+					continue
+				}
+				if replaced {
+					stats.replaced++
+				}
+				if *dryRun {
+					continue
+				}
+				if _, err = fmt.Fprintf(stateFile, "%s %s\n", user.ID, asset["id"]); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	saved := stats.originalsSize - stats.processedSize
+	if *dryRun {
+		log.Printf("%d assets to process (%s), %d processed: %s -> %s", stats.candidates, humanReadableSize(stats.candidatesSize), stats.processed, humanReadableSize(stats.originalsSize), humanReadableSize(stats.processedSize))
+		if stats.originalsSize > 0 {
+			// Assets left unprocessed are expected to shrink like the processed ones
+			estimate := saved + (stats.candidatesSize-stats.measuredSize)*saved/stats.originalsSize
+			log.Printf("estimated savings: %s (%.1f%%)", humanReadableSize(estimate), float64(saved)*100/float64(stats.originalsSize))
+		}
+		return nil
+	}
+	log.Printf("%d assets processed, %d replaced, %d failed, %s saved", stats.processed, stats.replaced, stats.failed, humanReadableSize(saved))
+	if stats.candidates > stats.processed {
+		log.Printf("%d assets left, run the command again to continue", stats.candidates-stats.processed)
+	}
+	if stats.failed > 0 {
+		return fmt.Errorf("%d assets failed, run the command again to retry", stats.failed)
+	}
+	return nil
+}
+
+// backfillTask Returns the task processing the asset and its size, nil if the asset must be left as is
+func backfillTask(asset Asset) (*Task, int64) {
+	if trashed, _ := asset["isTrashed"].(bool); trashed {
+		return nil, 0
+	}
+	// The video of a live photo is linked to the image by its id
+	if visibility, _ := asset["visibility"].(string); visibility == "hidden" {
+		return nil, 0
+	}
+	// Stored files already processed by IUO
+	checksum, _ := asset["checksum"].(string)
+	if _, ok := originalChecksum(checksum); ok {
+		return nil, 0
+	}
+	size := int64(-1)
+	if exif, ok := asset["exifInfo"].(map[string]any); ok {
+		if fileSize, ok := exif["fileSizeInByte"].(float64); ok {
+			size = int64(fileSize)
+		}
+	}
+	filename, _ := asset["originalFileName"].(string)
+	task, err := findTask(filename, size)
+	if err != nil {
+		return nil, 0
+	}
+	return task, max(size, 0)
+}
+
+// backfillAsset Downloads the stored file and runs the task, the asset is replaced if the processed file is smaller
+func backfillAsset(user *commandUser, asset Asset, task *Task, dryRun bool, logger *customLogger, stats *backfillStats) (bool, error) {
+	assetID := fmt.Sprint(asset["id"])
+	resp, err := immichRequest("GET", "/api/assets/"+assetID+"/original", user.Header, nil)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("download original: %s", resp.Status)
+	}
+	filename, _ := asset["originalFileName"].(string)
+	tp, err := NewTaskProcessor(task, resp.Body, filename)
+	if err != nil {
+		return false, err
+	}
+	defer tp.Close()
+	_ = resp.Body.Close()
+	tp.SetLogger(newCustomLogger(logger, path.Base(filename)+": "))
+	form := map[string][]string{}
+	for _, key := range []string{"deviceAssetId", "deviceId", "fileCreatedAt", "fileModifiedAt", "duration"} {
+		if value, ok := asset[key].(string); ok {
+			form[key] = []string{value}
+		}
+	}
+	tp.SetForm(form, user.Header)
+	smaller, err := optimizeAsset(user.Header, asset, tp, dryRun, logger)
+	if err != nil {
+		return false, err
+	}
+	stats.originalsSize += tp.OriginalSize
+	if !smaller {
+		stats.processedSize += tp.OriginalSize
+		return false, nil
+	}
+	stats.processedSize += tp.ProcessedSize
+	return !dryRun, nil
+}
+
+// optimizeAsset Runs the task on the original of the asset and replaces the stored file if the processed one is smaller,
+// unless dryRun. The checksums are recorded before the asset is replaced. Returns whether the processed file is smaller
+func optimizeAsset(header http.Header, asset Asset, tp *TaskProcessor, dryRun bool, logger *customLogger) (bool, error) {
+	if tp.OriginalSize < tp.Task.MinFilesizeBytes {
+		return false, nil
+	}
+	var err error
+	if tp.Task.IO == TaskIOStream {
+		err = runStreamToFile(tp)
+	} else {
+		err = tp.Run()
+	}
+	if err != nil {
+		return false, err
+	}
+	if tp.ProcessedFile == nil || tp.ProcessedSize >= tp.OriginalSize {
+		logger.Printf("kept: \"%s\" (%s), processed file isn't smaller", tp.OriginalFilename, humanReadableSize(tp.OriginalSize))
+		return false, nil
+	}
+	if dryRun {
+		logger.Printf("would replace: \"%s\" (%s) <- (%s) \"%s\"", tp.ProcessedFilename, humanReadableSize(tp.ProcessedSize), humanReadableSize(tp.OriginalSize), tp.OriginalFilename)
+		return true, nil
+	}
+	if err = tp.VerifyReconstruction(); err != nil {
+		return false, err
+	}
+	archived, err := archiveOriginal(tp)
+	if err != nil {
+		return false, err
+	}
+	processedHash, err := fileChecksum(tp.ProcessedFile.Name())
+	if err != nil {
+		discardArchivedOriginal(archived, logger)
+		return false, err
+	}
+	// Recorded first: clients must never see the processed file checksum, even if the command is interrupted
+	assetID := fmt.Sprint(asset["id"])
+	addChecksums(processedHash, tp.OriginalHash, archived, assetID, tp.Task.Name)
+	newID, err := replaceAsset(header, asset, tp.ProcessedFile, tp.ProcessedFilename)
+	if newID != "" && newID != assetID {
+		addChecksums(processedHash, tp.OriginalHash, archived, newID, tp.Task.Name)
+	}
+	if err != nil {
+		return false, err
+	}
+	logger.Printf("replaced: \"%s\" (%s) <- (%s) \"%s\"", tp.ProcessedFilename, humanReadableSize(tp.ProcessedSize), humanReadableSize(tp.OriginalSize), tp.OriginalFilename)
+	return true, nil
+}
+
+// runStreamToFile Runs a stream task and writes its output to a file, the asset can only be replaced with a complete file.
+// ProcessedFile stays nil if the output isn't smaller than the original
+func runStreamToFile(tp *TaskProcessor) (err error) {
+	if err = tp.RunStream(); err != nil || tp.ProcessedStream == nil {
+		return
+	}
+	if tp.tempWorkDir, err = os.MkdirTemp("", "processing-*"); err != nil {
+		return fmt.Errorf("unable to create temp folder: %w", err)
+	}
+	file, err := os.Create(path.Join(tp.tempWorkDir, "processed"+tp.ProcessedExtension))
+	if err != nil {
+		return fmt.Errorf("unable to create temp file: %w", err)
+	}
+	if _, err = io.Copy(file, tp.ProcessedStream); errors.Is(err, errStreamTooLarge) {
+		_ = file.Close()
+		return nil
+	}
+	if err != nil {
+		_ = file.Close()
+		return err
+	}
+	tp.ProcessedFile = file
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileCache Files on disk addressed by key, stored as <key><extension of the cached file>. Least recently used files are evicted once the total size goes over maxSize.
+// Concurrent Do calls for the same key share a single run of the function producing the file
+type fileCache struct {
+	dir     string
+	maxSize int64
+
+	lock    sync.Mutex
+	size    int64
+	lru     *list.List
+	entries map[string]*list.Element
+	flights map[string]*cacheFlight
+
+	hits   int64
+	misses int64
+}
+
+type cacheEntry struct {
+	key  string
+	ext  string
+	size int64
+}
+
+type cacheFlight struct {
+	done chan struct{}
+	err  error
+}
+
+// cacheKey Builds a file name safe key out of all the parts affecting the cached content
+func cacheKey(parts ...string) string {
+	hash := sha256.Sum256([]byte(strings.Join(parts, "\x00")))
+	return hex.EncodeToString(hash[:])
+}
+
+// newFileCache Opens the cache directory, files already in it are reused: recency is restored from their modification time
+func newFileCache(dir string, maxSize int64) (*fileCache, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("unable to create cache directory: %w", err)
+	}
+	fc := &fileCache{
+		dir:     dir,
+		maxSize: maxSize,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+		flights: make(map[string]*cacheFlight),
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read cache directory: %w", err)
+	}
+	var infos []os.FileInfo
+	for _, dirEntry := range dirEntries {
+		if info, err := dirEntry.Info(); err == nil && info.Mode().IsRegular() {
+			if strings.HasPrefix(info.Name(), ".") {
+				// Leftover of an interrupted Put
+				_ = os.Remove(filepath.Join(dir, info.Name()))
+				continue
+			}
+			infos = append(infos, info)
+		}
+	}
+	slices.SortFunc(infos, func(a, b os.FileInfo) int { return a.ModTime().Compare(b.ModTime()) })
+	for _, info := range infos {
+		// Keys are hex, the extension starts at the first dot
+		key, ext, _ := strings.Cut(info.Name(), ".")
+		if ext != "" {
+			ext = "." + ext
+		}
+		fc.entries[key] = fc.lru.PushFront(&cacheEntry{key, ext, info.Size()})
+		fc.size += info.Size()
+	}
+	fc.lock.Lock()
+	fc.evict(nil)
+	fc.lock.Unlock()
+	return fc, nil
+}
+
+func (fc *fileCache) path(key, ext string) string {
+	return filepath.Join(fc.dir, key+ext)
+}
+
+// Open Returns the cached file, opened while the cache is locked: evicting it doesn't affect the returned file
+func (fc *fileCache) Open(key string) (*os.File, bool) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	file, ok := fc.open(key)
+	if !ok {
+		fc.misses++
+		return nil, false
+	}
+	fc.hits++
+	return file, true
+}
+
+// open Must hold lock
+func (fc *fileCache) open(key string) (*os.File, bool) {
+	element, ok := fc.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := element.Value.(*cacheEntry)
+	path := fc.path(key, entry.ext)
+	file, err := os.Open(path)
+	if err != nil {
+		// Removed behind the cache back
+		fc.lru.Remove(element)
+		delete(fc.entries, key)
+		fc.size -= entry.size
+		return nil, false
+	}
+	fc.lru.MoveToFront(element)
+	// Modification time keeps the recency across restarts
+	now := time.Now()
+	_ = os.Chtimes(path, now, now)
+	return file, true
+}
+
+// Put Adds a copy of the file to the cache, hard linked when possible. The file stays where it is.
+// Files larger than the whole cache aren't added
+func (fc *fileCache) Put(key, file string) error {
+	info, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if info.Size() > fc.maxSize {
+		return fmt.Errorf("%s is larger than the cache", humanReadableSize(info.Size()))
+	}
+	ext := filepath.Ext(file)
+	path := fc.path(key, ext)
+	// Added under a hidden name first to never expose partial files
+	tmp := filepath.Join(fc.dir, "."+key)
+	_ = os.Remove(tmp)
+	if err = os.Link(file, tmp); err != nil {
+		// Links fail across file systems (e.g. from tmpfs)
+		if err = copyFile(file, tmp); err != nil {
+			_ = os.Remove(tmp)
+			return err
+		}
+	}
+	// Producers can set the file time (e.g. exiftool to the capture date), it must be the recency
+	now := time.Now()
+	_ = os.Chtimes(tmp, now, now)
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if err = os.Rename(tmp, path); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if element, ok := fc.entries[key]; ok {
+		entry := fc.lru.Remove(element).(*cacheEntry)
+		fc.size -= entry.size
+		if entry.ext != ext {
+			_ = os.Remove(fc.path(key, entry.ext))
+		}
+	}
+	element := fc.lru.PushFront(&cacheEntry{key, ext, info.Size()})
+	fc.entries[key] = element
+	fc.size += info.Size()
+	fc.evict(element)
+	return nil
+}
+
+// Do Returns the cached file or produces it with fn, opened. fn returns the path of a file that gets copied into the cache:
+// the caller removes it once the returned file is closed. Caching is best effort, a file that can't be cached is returned as is.
+// Concurrent calls with the same key wait for the first one instead of running fn again
+func (fc *fileCache) Do(key string, fn func() (string, error)) (*os.File, error) {
+	if file, ok := fc.Open(key); ok {
+		return file, nil
+	}
+	fc.lock.Lock()
+	if flight, ok := fc.flights[key]; ok {
+		fc.lock.Unlock()
+		<-flight.done
+		if flight.err != nil {
+			return nil, flight.err
+		}
+		fc.lock.Lock()
+		file, ok := fc.open(key)
+		fc.lock.Unlock()
+		if ok {
+			return file, nil
+		}
+		// The first file couldn't be cached
+		return fc.produce(key, fn)
+	}
+	flight := &cacheFlight{done: make(chan struct{})}
+	fc.flights[key] = flight
+	fc.lock.Unlock()
+
+	var file *os.File
+	file, flight.err = fc.produce(key, fn)
+	fc.lock.Lock()
+	delete(fc.flights, key)
+	fc.lock.Unlock()
+	close(flight.done)
+	return file, flight.err
+}
+
+// produce Runs fn, adds its file to the cache and opens it
+func (fc *fileCache) produce(key string, fn func() (string, error)) (*os.File, error) {
+	produced, err := fn()
+	if err != nil {
+		return nil, err
+	}
+	if err = fc.Put(key, produced); err != nil {
+		log.Printf("cache: unable to add %s: %v", key, err)
+	}
+	return os.Open(produced)
+}
+
+// HitRate Returns hits, misses and the ratio of hits
+func (fc *fileCache) HitRate() (hits, misses int64, ratio float64) {
+	fc.lock.Lock()
+	defer fc.lock.Unlock()
+	if fc.hits+fc.misses > 0 {
+		ratio = float64(fc.hits) / float64(fc.hits+fc.misses)
+	}
+	return fc.hits, fc.misses, ratio
+}
+
+// evict Must hold lock. keep is never evicted, nil if none
+func (fc *fileCache) evict(keep *list.Element) {
+	for fc.size > fc.maxSize && fc.lru.Len() > 0 && fc.lru.Back() != keep {
+		entry := fc.lru.Remove(fc.lru.Back()).(*cacheEntry)
+		delete(fc.entries, entry.key)
+		fc.size -= entry.size
+		if err := os.Remove(fc.path(entry.key, entry.ext)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Printf("cache: unable to evict %s: %v", entry.key, err)
+		}
+	}
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -1,84 +1,415 @@
 package main
 
 import (
-	"bufio"
 	"crypto/sha1"
 	"encoding/base64"
+	"encoding/csv"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"log"
 	"net/http"
 	"os"
 	"path"
 	"slices"
 	"strconv"
-	"strings"
 	"sync"
+	"time"
 )
 
-func SHA1(file io.ReadSeeker) (string, error) {
-	if _, err := file.Seek(0, io.SeekStart); err != nil {
-		return "", fmt.Errorf("unable to seek beginning of file: %w", err)
-	}
-	hasher := sha1.New()
-	if _, err := io.Copy(hasher, file); err != nil {
-		return "", fmt.Errorf("could not copy file content to hasher: %v", err)
-	}
-	return base64.StdEncoding.EncodeToString(hasher.Sum(nil)), nil
+// encodeChecksum Encodes a hash like immich does for asset checksums
+func encodeChecksum(hasher hash.Hash) string {
+	return base64.StdEncoding.EncodeToString(hasher.Sum(nil))
 }
 
 var mapLock sync.RWMutex
 var fakeToOriginalChecksum map[string]string
 
+// fakeToVault Vault location of the original replaced by the stored file
+var fakeToVault map[string]string
+
+// assetToFake Stored file checksum of the assets uploaded by IUO, used to forget the records of deleted assets
+var assetToFake map[string]string
+
+// checksumWrites Pending appends to the checksums file, reloads and commands wait for them
+var checksumWrites = newPendingWrites()
+
+// pendingWrites Numbers the writes in progress. Unlike a WaitGroup, writes can start while Wait is waiting:
+// Wait only waits for the writes started before it's called, it can't be starved by new ones
+type pendingWrites struct {
+	lock    sync.Mutex
+	done    *sync.Cond
+	next    uint64
+	pending map[uint64]bool
+}
+
+func newPendingWrites() *pendingWrites {
+	pw := &pendingWrites{pending: make(map[uint64]bool)}
+	pw.done = sync.NewCond(&pw.lock)
+	return pw
+}
+
+// Start Registers a write, Finish must be called with the returned number once it's done
+func (pw *pendingWrites) Start() uint64 {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	seq := pw.next
+	pw.next++
+	pw.pending[seq] = true
+	return seq
+}
+
+func (pw *pendingWrites) Finish(seq uint64) {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	delete(pw.pending, seq)
+	pw.done.Broadcast()
+}
+
+// Wait Returns once the writes started before the call are done
+func (pw *pendingWrites) Wait() {
+	pw.lock.Lock()
+	defer pw.lock.Unlock()
+	before := pw.next
+	for pw.pendingBefore(before) {
+		pw.done.Wait()
+	}
+}
+
+// pendingBefore Must hold lock
+func (pw *pendingWrites) pendingBefore(before uint64) bool {
+	for seq := range pw.pending {
+		if seq < before {
+			return true
+		}
+	}
+	return false
+}
+
+// checksumsLoaded The checksums file as last read and its size: instances sharing the file only read what others appended since
+var checksumsLoaded os.FileInfo
+var checksumsOffset int64
+
+// initChecksums Loads the checksums file: fake,original[,vault[,asset_id[,created[,task]]]] records.
+// A stored file can have several records, one for each asset having it
 func initChecksums() {
-	fakeToOriginalChecksum = make(map[string]string)
+	mapLock.Lock()
+	defer mapLock.Unlock()
+	checksumsLoaded = nil
+	if err := loadChecksums(); err != nil {
+		fmt.Println("Error reading csv:", err)
+	}
+}
+
+// loadChecksums Reads the records appended to the checksums file since it was last loaded, all of them if it was rewritten.
+// mapLock must be held for writing
+func loadChecksums() error {
+	unlock, err := lockChecksums(false)
+	if err != nil {
+		return err
+	}
+	defer unlock()
 	file, err := os.OpenFile(checksumsFile, os.O_CREATE|os.O_RDONLY, 0644)
 	if err != nil {
-		return
+		return err
 	}
 	defer file.Close()
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		kv := strings.Split(scanner.Text(), ",")
-		fakeToOriginalChecksum[kv[0]] = kv[1]
+	info, err := file.Stat()
+	if err != nil {
+		return err
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Println("Error reading csv:", err)
+	var offset int64
+	if checksumsLoaded != nil && os.SameFile(info, checksumsLoaded) && info.Size() >= checksumsOffset {
+		offset = checksumsOffset
+	} else {
+		fakeToOriginalChecksum = make(map[string]string)
+		fakeToVault = make(map[string]string)
+		assetToFake = make(map[string]string)
 	}
+	if _, err = file.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	// Writers hold the exclusive lock, the file can't grow while it's read
+	checksumsLoaded, checksumsOffset = info, info.Size()
+	reader := csv.NewReader(io.LimitReader(file, info.Size()-offset))
+	reader.FieldsPerRecord = -1
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			fmt.Println("Error reading csv:", err)
+			var parseErr *csv.ParseError
+			if errors.As(err, &parseErr) {
+				continue
+			}
+			break
+		}
+		parsed, ok := parseChecksumRecord(record)
+		if !ok {
+			continue
+		}
+		fakeToOriginalChecksum[parsed.Fake] = parsed.Original
+		if parsed.Vault != "" {
+			fakeToVault[parsed.Fake] = parsed.Vault
+		}
+		if parsed.AssetID != "" {
+			assetToFake[parsed.AssetID] = parsed.Fake
+		}
+	}
+	return nil
 }
 
-func addChecksums(fake, original string) {
-	go func() {
+// watchChecksums Loads the records added by the other IUO instances sharing the checksums file
+func watchChecksums() {
+	for {
+		time.Sleep(checksumsReloadInterval)
+		info, err := os.Stat(checksumsFile)
+		if err != nil {
+			continue
+		}
+		mapLock.RLock()
+		changed := checksumsLoaded == nil || !os.SameFile(info, checksumsLoaded) || info.Size() != checksumsOffset
+		mapLock.RUnlock()
+		if !changed {
+			continue
+		}
+		// Records of this instance must be in the file, a rewritten file replaces the maps.
+		// Waited for before locking the maps: uploads and downloads keep reading them meanwhile
+		checksumWrites.Wait()
 		mapLock.Lock()
-		fakeToOriginalChecksum[fake] = original
+		records := len(fakeToOriginalChecksum)
+		err = loadChecksums()
+		records = len(fakeToOriginalChecksum) - records
 		mapLock.Unlock()
-		_ = appendToCSV(fake, original)
+		if err != nil {
+			log.Printf("checksums: reload: %v", err)
+		} else if records != 0 {
+			log.Printf("checksums: reloaded, %+d stored files", records)
+		}
+	}
+}
+
+// lockChecksums Locks the checksums file across the IUO instances and commands sharing it, writers take an exclusive lock.
+// The lock is taken on a separate file, the checksums file is replaced when records are removed
+func lockChecksums(exclusive bool) (unlock func(), err error) {
+	file, err := os.OpenFile(checksumsFile+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	if err = lockFile(file, exclusive); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("lock %s: %w", file.Name(), err)
+	}
+	return func() {
+		_ = unlockFile(file)
+		_ = file.Close()
+	}, nil
+}
+
+// checksumRecord A record of the checksums file. Records written by older versions have no vault, asset id, creation time or task
+type checksumRecord struct {
+	Fake     string    `json:"fake"`
+	Original string    `json:"original"`
+	Vault    string    `json:"vault,omitempty"`
+	AssetID  string    `json:"asset_id,omitempty"`
+	Created  time.Time `json:"created,omitzero"`
+	Task     string    `json:"task,omitempty"`
+}
+
+// parseChecksumRecord Parses a CSV record, ok is false if it has no original
+func parseChecksumRecord(fields []string) (record checksumRecord, ok bool) {
+	if len(fields) < 2 {
+		return record, false
+	}
+	record.Fake, record.Original = fields[0], fields[1]
+	if len(fields) > 2 {
+		record.Vault = fields[2]
+	}
+	if len(fields) > 3 {
+		record.AssetID = fields[3]
+	}
+	if len(fields) > 4 {
+		record.Created, _ = time.Parse(time.RFC3339, fields[4])
+	}
+	if len(fields) > 5 {
+		record.Task = fields[5]
+	}
+	return record, true
+}
+
+// fields CSV record, empty trailing fields are left out
+func (record checksumRecord) fields() []string {
+	var created string
+	if !record.Created.IsZero() {
+		created = record.Created.UTC().Format(time.RFC3339)
+	}
+	fields := []string{record.Fake, record.Original, record.Vault, record.AssetID, created, record.Task}
+	for len(fields) > 2 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return fields
+}
+
+// addChecksums Records the stored file replacing the original, location is the vault location of the original if archived.
+// assetID is the immich asset having the stored file, empty if unknown. task is the name of the task that made the stored file.
+// The record is appended to the checksums file in the background, the returned channel gets the result
+func addChecksums(fake, original, location, assetID, task string) <-chan error {
+	// The map is updated right away, conversions following the upload may need it
+	mapLock.Lock()
+	fakeToOriginalChecksum[fake] = original
+	if location != "" {
+		fakeToVault[fake] = location
+	}
+	if assetID != "" {
+		assetToFake[assetID] = fake
+	}
+	// Started before the maps are unlocked: a reload waiting for the pending writes can't miss this record
+	write := checksumWrites.Start()
+	mapLock.Unlock()
+	record := checksumRecord{fake, original, location, assetID, time.Now(), task}
+	written := make(chan error, 1)
+	go func() {
+		defer checksumWrites.Finish(write)
+		err := appendToCSV(record.fields())
+		if err != nil {
+			log.Printf("checksums: unable to record %s: %v", fake, err)
+		}
+		written <- err
 	}()
+	return written
+}
+
+func appendToCSV(records ...[]string) error {
+	unlock, err := lockChecksums(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	return appendRecords(records)
 }
 
-func appendToCSV(key, value string) error {
+// appendRecords Appends records to the checksums file, the exclusive lock must be held
+func appendRecords(records [][]string) error {
 	file, err := os.OpenFile(checksumsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
-	if _, err := io.WriteString(file, key+","+value+"\n"); err != nil {
-		return err
+	return csv.NewWriter(file).WriteAll(records)
+}
+
+// removeChecksums Forgets stored files that no longer replace an original, the checksums file is rewritten atomically
+func removeChecksums(fakes map[string]bool) error {
+	_, err := removeChecksumRecords(func(record []string) bool { return fakes[record[0]] })
+	return err
+}
+
+// removeChecksumRecords Removes the records matching remove from the checksums file, rewritten atomically.
+// A stored file is forgotten once it has no records left. Returns the removed records
+func removeChecksumRecords(remove func(record []string) bool) (removed [][]string, err error) {
+	mapLock.Lock()
+	defer mapLock.Unlock()
+	unlock, err := lockChecksums(true)
+	if err != nil {
+		return nil, err
 	}
-	return nil
+	defer unlock()
+	file, err := os.Open(checksumsFile)
+	if err != nil {
+		return nil, err
+	}
+	reader := csv.NewReader(file)
+	reader.FieldsPerRecord = -1
+	records, err := reader.ReadAll()
+	_ = file.Close()
+	if err != nil {
+		return nil, err
+	}
+	temp, err := os.CreateTemp(path.Dir(checksumsFile), ".checksums-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(temp.Name())
+	writer := csv.NewWriter(temp)
+	kept := map[string]bool{}
+	for _, record := range records {
+		if len(record) == 0 {
+			continue
+		}
+		if remove(record) {
+			removed = append(removed, record)
+			continue
+		}
+		kept[record[0]] = true
+		_ = writer.Write(record)
+	}
+	writer.Flush()
+	if err = writer.Error(); err != nil {
+		_ = temp.Close()
+		return nil, err
+	}
+	if err = temp.Chmod(0644); err != nil {
+		_ = temp.Close()
+		return nil, err
+	}
+	if err = temp.Close(); err != nil {
+		return nil, err
+	}
+	if err = os.Rename(temp.Name(), checksumsFile); err != nil {
+		return nil, err
+	}
+	for _, record := range removed {
+		if len(record) > 3 && record[3] != "" {
+			delete(assetToFake, record[3])
+		}
+		if !kept[record[0]] {
+			delete(fakeToOriginalChecksum, record[0])
+			delete(fakeToVault, record[0])
+		}
+	}
+	return removed, nil
+}
+
+// originalChecksum Returns the checksum of the original file replaced by the stored one, ok is false if the stored file wasn't processed by IUO
+func originalChecksum(fake string) (original string, ok bool) {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	original, ok = fakeToOriginalChecksum[fake]
+	return
+}
+
+// fileChecksum Hashes a file like immich does
+func fileChecksum(name string) (string, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hasher := sha1.New()
+	if _, err = io.Copy(hasher, file); err != nil {
+		return "", err
+	}
+	return encodeChecksum(hasher), nil
 }
 
 type Asset map[string]any
 
-// toOriginalAsset: Must acquire mapLock.RLock() before calling
-func (asset Asset) toOriginalAsset() {
-	if downloadJpgFromJxl || downloadJpgFromAvif {
-		if n, ok := asset["originalFileName"]; ok {
-			if originalFileName, ok := n.(string); ok {
-				extension := strings.ToLower(path.Ext(originalFileName))
-				if (downloadJpgFromJxl && extension == ".jxl") || (downloadJpgFromAvif && extension == ".avif") {
-					asset["originalFileName"] = originalFileName + ".jpg"
+// toOriginalAsset: Must acquire mapLock.RLock() before calling. header is the client request, downloads are converted to the format negotiated with it
+func (asset Asset) toOriginalAsset(header http.Header) {
+	if n, ok := asset["originalFileName"]; ok {
+		if originalFileName, ok := n.(string); ok {
+			// Advertise the name of the converted file downloads will return
+			mimeType, _ := asset["originalMimeType"].(string)
+			if mimeType == "" {
+				mimeType = mimeTypeByExtension(path.Ext(originalFileName))
+			}
+			if downloadTask := findDownloadTask(mimeType); downloadTask != nil {
+				if format, convert := negotiateFormat(header, mimeType, downloadTask); convert {
+					asset["originalFileName"] = originalFileName + imageFormats[format].Extension
 				}
 			}
 		}
@@ -111,6 +442,10 @@ func getChecksumReplacer(w http.ResponseWriter, r *http.Request, logger *customL
 	if isAlbum(r) {
 		return &Replacer{w, r, logger, TypeAlbum}
 	}
+	// Shared link guests get the same file names as the owner
+	if isSharedLink(r) {
+		return &Replacer{w, r, logger, TypeAlbum}
+	}
 	/*
 		if isBucket(r) {
 			return &Replacer{w, r, logger, TypeBucket}
@@ -170,18 +505,28 @@ func (replacer Replacer) Replace() (err error) {
 			if err = json.Unmarshal(fixedJsonBuf, &streams); logger.Error(err, "json unmarshal") {
 				return
 			}
+			var deleted []string
 			for _, value := range streams {
 				if v, ok := value.(map[string]any); ok {
+					if t, _ := v["type"].(string); t == "AssetDeleteV1" {
+						if data, ok := v["data"].(map[string]any); ok {
+							deleted = append(deleted, fmt.Sprint(data["assetId"]))
+						}
+						continue
+					}
 					if t, ok := v["type"].(string); ok && !slices.Contains([]string{"AssetV1", "AlbumAssetCreateV1", "AlbumAssetUpdateV1", "AlbumAssetBackfillV1", "PartnerAssetV1", "PartnerAssetBackfillV1"}, t) {
 						continue
 					}
 					if asset, ok := v["data"].(map[string]any); ok {
 						mapLock.RLock()
-						Asset(asset).toOriginalAsset()
+						Asset(asset).toOriginalAsset(r.Header)
 						mapLock.RUnlock()
 					}
 				}
 			}
+			if len(deleted) > 0 && checksumsGCGrace > 0 {
+				observeDeletedAssets(deleted, logger)
+			}
 			if jsonBuf, err = json.Marshal(streams); logger.Error(err, "json marshal") {
 				return
 			}
@@ -206,7 +551,7 @@ func (replacer Replacer) Replace() (err error) {
 					mapLock.RLock()
 					for _, a := range assets {
 						if asset, ok := a.(map[string]any); ok {
-							Asset(asset).toOriginalAsset()
+							Asset(asset).toOriginalAsset(r.Header)
 						}
 					}
 					mapLock.RUnlock()
@@ -225,7 +570,7 @@ func (replacer Replacer) Replace() (err error) {
 			}
 			mapLock.RLock()
 			for _, asset := range assets {
-				asset.toOriginalAsset()
+				asset.toOriginalAsset(r.Header)
 			}
 			mapLock.RUnlock()
 			if jsonBuf, err = json.Marshal(assets); logger.Error(err, "json marshal") {
@@ -237,7 +582,7 @@ func (replacer Replacer) Replace() (err error) {
 				return
 			}
 			mapLock.RLock()
-			asset.toOriginalAsset()
+			asset.toOriginalAsset(r.Header)
 			mapLock.RUnlock()
 			if jsonBuf, err = json.Marshal(asset); logger.Error(err, "json marshal") {
 				return
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// checksumsFilter Selects records by creation time and task, records written by older versions have neither and only match an empty filter
+type checksumsFilter struct {
+	since, until time.Time
+	tasks        []string
+}
+
+// addFlags Defines the filter flags of a checksums subcommand
+func (f *checksumsFilter) addFlags(flags *flag.FlagSet) {
+	flags.Func("since", "Only records created at or after this date: 2006-01-02 or RFC3339", func(value string) (err error) {
+		f.since, err = parseDateFlag(value)
+		return
+	})
+	flags.Func("until", "Only records created before this date: 2006-01-02 or RFC3339", func(value string) (err error) {
+		f.until, err = parseDateFlag(value)
+		return
+	})
+	flags.Func("task", "Comma separated names of the tasks that made the stored files", func(value string) error {
+		f.tasks = strings.Split(value, ",")
+		return nil
+	})
+}
+
+func (f *checksumsFilter) match(record checksumRecord) bool {
+	if !f.since.IsZero() && (record.Created.IsZero() || record.Created.Before(f.since)) {
+		return false
+	}
+	if !f.until.IsZero() && (record.Created.IsZero() || !record.Created.Before(f.until)) {
+		return false
+	}
+	return len(f.tasks) == 0 || slices.Contains(f.tasks, record.Task)
+}
+
+func parseDateFlag(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation(time.DateOnly, value, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// runChecksums Tools working on the checksums file: export, import, merge and stats. They don't need immich
+func runChecksums(args []string) error {
+	subcommands := map[string]func(args []string) error{
+		"export": runChecksumsExport,
+		"import": func(args []string) error { return runChecksumsImport("import", args) },
+		"merge":  func(args []string) error { return runChecksumsImport("merge", args) },
+		"stats":  runChecksumsStats,
+	}
+	if len(args) == 0 || subcommands[args[0]] == nil {
+		return errors.New("usage: checksums export|import|merge|stats [flags]")
+	}
+	return subcommands[args[0]](args[1:])
+}
+
+// runChecksumsExport Writes the records of the checksums file as CSV, like the checksums file, or as JSON
+func runChecksumsExport(args []string) error {
+	flags := flag.NewFlagSet("checksums export", flag.ContinueOnError)
+	format := flags.String("format", "csv", "Output format: csv or json")
+	output := flags.String("o", "", "Output file. Default: standard output")
+	var filter checksumsFilter
+	filter.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *format != "csv" && *format != "json" {
+		return fmt.Errorf("unknown format: %s", *format)
+	}
+	records, err := readChecksumsFile()
+	if err != nil {
+		return err
+	}
+	records = slices.DeleteFunc(records, func(record checksumRecord) bool { return !filter.match(record) })
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+	if *format == "json" {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(records)
+	} else {
+		writer := csv.NewWriter(out)
+		for _, record := range records {
+			_ = writer.Write(record.fields())
+		}
+		writer.Flush()
+		err = writer.Error()
+	}
+	if err != nil {
+		return err
+	}
+	log.Printf("%d records exported", len(records))
+	return out.Close()
+}
+
+// runChecksumsImport Adds the records of a file to the checksums file, records already present are skipped.
+// A conflict is a stored file mapped to another original than in the checksums file: import adds nothing if there's any, merge skips them
+func runChecksumsImport(name string, args []string) error {
+	flags := flag.NewFlagSet("checksums "+name, flag.ContinueOnError)
+	dryRun := flags.Bool("dry_run", false, "Print what would be added without changing the checksums file")
+	var filter checksumsFilter
+	filter.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return fmt.Errorf("usage: checksums %s [flags] <file>", name)
+	}
+	file, err := os.Open(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	input, err := readChecksumRecords(file)
+	_ = file.Close()
+	if err != nil {
+		return fmt.Errorf("%s: %w", flags.Arg(0), err)
+	}
+
+	// Other IUO instances sharing the checksums file can't write until the records are added
+	unlock, err := lockChecksums(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	current, err := readChecksumsFile()
+	if err != nil {
+		return err
+	}
+	originals := map[string]string{}
+	present := map[checksumRecord]bool{}
+	for _, record := range current {
+		originals[record.Fake] = record.Original
+		present[checksumRecord{Fake: record.Fake, Original: record.Original, AssetID: record.AssetID}] = true
+	}
+	var added [][]string
+	skipped, conflicts := 0, 0
+	for _, record := range input {
+		if !filter.match(record) {
+			continue
+		}
+		if original, ok := originals[record.Fake]; ok && original != record.Original {
+			log.Printf("conflict: %s -> %s, the checksums file maps it to %s", record.Fake, record.Original, original)
+			conflicts++
+			continue
+		}
+		key := checksumRecord{Fake: record.Fake, Original: record.Original, AssetID: record.AssetID}
+		// A record without asset id is already present if the stored file is mapped
+		if _, ok := originals[record.Fake]; present[key] || ok && record.AssetID == "" {
+			skipped++
+			continue
+		}
+		originals[record.Fake] = record.Original
+		present[key] = true
+		added = append(added, record.fields())
+	}
+	log.Printf("%d records to add, %d already present, %d conflicts", len(added), skipped, conflicts)
+	if conflicts > 0 && name == "import" {
+		return fmt.Errorf("%d conflicts, nothing imported. Use merge to add the other records", conflicts)
+	}
+	if *dryRun || len(added) == 0 {
+		return nil
+	}
+	if err = appendRecords(added); err != nil {
+		return fmt.Errorf("unable to update the checksums file: %w", err)
+	}
+	log.Printf("%d records added to %s", len(added), checksumsFile)
+	return nil
+}
+
+// runChecksumsStats Prints the number of records by task and month, and the conflicting records of the checksums file
+func runChecksumsStats(args []string) error {
+	flags := flag.NewFlagSet("checksums stats", flag.ContinueOnError)
+	var filter checksumsFilter
+	filter.addFlags(flags)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	records, err := readChecksumsFile()
+	if err != nil {
+		return err
+	}
+	originals := map[string][]string{}
+	tasks := map[string]int{}
+	months := map[string]int{}
+	count, archived, withAsset := 0, 0, 0
+	for _, record := range records {
+		if !filter.match(record) {
+			continue
+		}
+		count++
+		if !slices.Contains(originals[record.Fake], record.Original) {
+			originals[record.Fake] = append(originals[record.Fake], record.Original)
+		}
+		if record.Vault != "" {
+			archived++
+		}
+		if record.AssetID != "" {
+			withAsset++
+		}
+		task := record.Task
+		if task == "" {
+			task = "(unknown)"
+		}
+		tasks[task]++
+		month := "(unknown)"
+		if !record.Created.IsZero() {
+			month = record.Created.Local().Format("2006-01")
+		}
+		months[month]++
+	}
+	log.Printf("%s: %d records, %d stored files, %d originals archived in the vault, %d with an asset id", checksumsFile, count, len(originals), archived, withAsset)
+	for _, task := range slices.Sorted(maps.Keys(tasks)) {
+		log.Printf("task %s: %d records", task, tasks[task])
+	}
+	for _, month := range slices.Sorted(maps.Keys(months)) {
+		log.Printf("created %s: %d records", month, months[month])
+	}
+	conflicts := 0
+	for _, fake := range slices.Sorted(maps.Keys(originals)) {
+		if len(originals[fake]) > 1 {
+			// The last record wins
+			log.Printf("conflict: %s -> %s", fake, strings.Join(originals[fake], ", "))
+			conflicts++
+		}
+	}
+	if conflicts > 0 {
+		return fmt.Errorf("%d stored files mapped to several originals", conflicts)
+	}
+	return nil
+}
+
+// readChecksumsFile Reads every record of the checksums file
+func readChecksumsFile() ([]checksumRecord, error) {
+	file, err := os.Open(checksumsFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readChecksumRecords(file)
+}
+
+// readChecksumRecords Reads records from a checksums file or from a CSV or JSON export
+func readChecksumRecords(reader io.Reader) (records []checksumRecord, err error) {
+	buffered := bufio.NewReader(reader)
+	// JSON exports are an array
+	head, _ := buffered.Peek(512)
+	if head = bytes.TrimLeft(head, " \t\r\n"); len(head) > 0 && head[0] == '[' {
+		if err = json.NewDecoder(buffered).Decode(&records); err != nil {
+			return nil, err
+		}
+		return slices.DeleteFunc(records, func(record checksumRecord) bool { return record.Fake == "" || record.Original == "" }), nil
+	}
+	csvReader := csv.NewReader(buffered)
+	csvReader.FieldsPerRecord = -1
+	for {
+		fields, err := csvReader.Read()
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if record, ok := parseChecksumRecord(fields); ok {
+			records = append(records, record)
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Command Runs instead of the proxy: immich-upload-optimizer [flags] <command> [command flags]
+type Command struct {
+	Name        string
+	Description string
+	Run         func(args []string) error
+}
+
+func getCommands() []*Command {
+	return []*Command{
+		{"validate", "Check the tasks file for errors and warnings", runValidate},
+		{"backfill", "Process the assets already in immich with the tasks, replacing them and recording the checksums", runBackfill},
+		{"checksums", "Export, import, merge or show stats of the checksums file: checksums export|import|merge|stats", runChecksums},
+		{"export", "Download the library to a directory in the original formats, only the assets updated since the last export", runExport},
+		{"fsck", "Check the checksums file against the assets in immich, -fix fixes the problems found", runFsck},
+		{"restore", "Replace the processed files in immich with the originals archived in the vault", runRestore},
+	}
+}
+
+func runCommand(args []string) int {
+	for _, command := range getCommands() {
+		if command.Name != args[0] {
+			continue
+		}
+		err := command.Run(args[1:])
+		checksumWrites.Wait()
+		if err != nil {
+			if !errors.Is(err, flag.ErrHelp) {
+				log.Printf("%s: %v", command.Name, err)
+			}
+			return 1
+		}
+		return 0
+	}
+	log.Printf("unknown command: %s", args[0])
+	printUsage()
+	return 2
+}
+
+func printUsage() {
+	out := flag.CommandLine.Output()
+	_, _ = fmt.Fprintf(out, "Usage: %s [flags] [command] [command flags]\n\nCommands:\n", os.Args[0])
+	for _, command := range getCommands() {
+		_, _ = fmt.Fprintf(out, "  %s\n    \t%s\n", command.Name, command.Description)
+	}
+	_, _ = fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// commandUser An immich user processed by a command, authenticated by its API key
+type commandUser struct {
+	ID     string
+	Email  string
+	Header http.Header
+}
+
+// initCommand Checks the flags commands talking to immich need, loads the checksums and returns the users of -api_key
+func initCommand() (users []*commandUser, err error) {
+	if upstreamURL == "" {
+		return nil, errors.New("the -upstream flag is required")
+	}
+	if remote, err = url.Parse(upstreamURL); err != nil {
+		return nil, fmt.Errorf("invalid upstream URL: %w", err)
+	}
+	if apiKeys == "" {
+		return nil, errors.New("the -api_key flag is required")
+	}
+	initChecksums()
+	for _, apiKey := range strings.Split(apiKeys, ",") {
+		header := apiKeyHeader(strings.TrimSpace(apiKey))
+		user, err := getImmichUser(header)
+		if err != nil {
+			return nil, fmt.Errorf("invalid API key: %w", err)
+		}
+		users = append(users, &commandUser{fmt.Sprint(user["id"]), fmt.Sprint(user["email"]), header})
+	}
+	return users, nil
+}
+
+// selectUsers Returns the users matching filter: comma separated emails or ids, all if empty
+func selectUsers(users []*commandUser, filter string) (selected []*commandUser) {
+	filters := strings.Split(filter, ",")
+	for _, user := range users {
+		if filter == "" || slices.Contains(filters, user.ID) || slices.Contains(filters, user.Email) {
+			selected = append(selected, user)
+		}
+	}
+	return
+}
+
+func runValidate(args []string) error {
+	flags := flag.NewFlagSet("validate", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	c, err := NewConfig(&configFile)
+	if err != nil {
+		return err
+	}
+	warnings := 0
+	for _, task := range c.Tasks {
+		for _, warning := range task.Warnings() {
+			log.Printf("task %s: warning: %s", task.Name, warning)
+			warnings++
+		}
+	}
+	log.Printf("%s: %d tasks, %d warnings", configFile, len(c.Tasks), warnings)
+	return nil
+}
@@ -4,44 +4,206 @@ import (
 	"bytes"
 	"fmt"
 	"log"
+	"os/exec"
+	"path"
+	"slices"
+	"strings"
 	"text/template"
+	"time"
 
 	"github.com/spf13/viper"
 )
 
+const (
+	TaskIOFile   = "file"
+	TaskIOStream = "stream"
+)
+
+const defaultStreamBufferBytes = 32 << 20
+
 type Task struct {
-	Name             string   `mapstructure:"name"`
-	Extensions       []string `mapstructure:"extensions"`
-	Command          string   `mapstructure:"command"`
-	MinFilesizeBytes int64    `mapstructure:"min_filesize,omitempty"`
-	CommandTemplate  *template.Template
+	Name                 string         `mapstructure:"name"`
+	Extensions           []string       `mapstructure:"extensions"`
+	Command              string         `mapstructure:"command,omitempty"`
+	Args                 []string       `mapstructure:"args,omitempty"`
+	MinFilesizeBytes     int64          `mapstructure:"min_filesize,omitempty"`
+	IO                   string         `mapstructure:"io,omitempty"`
+	OutputExtension      string         `mapstructure:"output_extension,omitempty"`
+	StreamBufferBytes    int64          `mapstructure:"stream_buffer,omitempty"`
+	Params               map[string]any `mapstructure:"params,omitempty"`
+	VerifyReconstruction bool           `mapstructure:"verify_reconstruction,omitempty"`
+	VaultRetention       string         `mapstructure:"vault_retention,omitempty"`
+	Async                bool           `mapstructure:"async,omitempty"`
+	Schedule             string         `mapstructure:"schedule,omitempty"`
+	CommandTemplate      *template.Template
+	ArgsTemplates        []*template.Template
+	usesUser             bool
+	vaultRetention       time.Duration
+	schedule             []scheduleWindow
 }
 
 func (task *Task) Init() (err error) {
-	values := map[string]string{
-		"folder":    "/folder",
-		"name":      "name",
-		"extension": "ext",
+	switch task.IO {
+	case "":
+		task.IO = TaskIOFile
+	case TaskIOFile:
+	case TaskIOStream:
+		if !isValidFilename(task.OutputExtension) {
+			return fmt.Errorf("task %s: io: stream requires a valid output_extension", task.Name)
+		}
+		task.OutputExtension = strings.TrimPrefix(task.OutputExtension, ".")
+		if task.StreamBufferBytes <= 0 {
+			task.StreamBufferBytes = defaultStreamBufferBytes
+		}
+	default:
+		return fmt.Errorf("task %s: invalid io: %s", task.Name, task.IO)
+	}
+	if task.vaultRetention, err = parseRetention(task.VaultRetention); err != nil {
+		return fmt.Errorf("task %s: vault_retention: %v", task.Name, err)
+	}
+	if task.schedule, err = parseSchedule(task.Schedule); err != nil {
+		return fmt.Errorf("task %s: schedule: %v", task.Name, err)
+	}
+	if task.Schedule != "" && !task.Async {
+		return fmt.Errorf("task %s: schedule requires async: true", task.Name)
+	}
+	if task.VerifyReconstruction && task.IO == TaskIOStream {
+		return fmt.Errorf("task %s: verify_reconstruction requires io: file", task.Name)
 	}
 
-	task.CommandTemplate, err = template.New("command").Parse(task.Command)
-	if err != nil {
-		err = fmt.Errorf("task %s unable to parse command: %v", task.Name, err)
-		return
+	switch {
+	case task.Command != "" && len(task.Args) > 0:
+		return fmt.Errorf("task %s: command and args can't be used together", task.Name)
+	case len(task.Args) > 0:
+		if strings.TrimSpace(task.Args[0]) == "" {
+			return fmt.Errorf("task %s: args[0] must be the program to run", task.Name)
+		}
+		task.ArgsTemplates = make([]*template.Template, len(task.Args))
+		for i, arg := range task.Args {
+			task.ArgsTemplates[i], err = parseTemplate("arg", arg)
+			if err != nil {
+				err = fmt.Errorf("task %s unable to parse args[%d]: %v", task.Name, i, err)
+				return
+			}
+		}
+	case task.Command == "":
+		return fmt.Errorf("task %s: args or command is required", task.Name)
+	default:
+		task.CommandTemplate, err = parseTemplate("command", task.Command)
+		if err != nil {
+			err = fmt.Errorf("task %s unable to parse command: %v", task.Name, err)
+			return
+		}
 	}
 
-	var cmdLine bytes.Buffer
-	err = task.CommandTemplate.Execute(&cmdLine, values)
-	if err != nil {
-		err = fmt.Errorf("task %s unable to execute template for command: %v", task.Name, err)
-		return
+	fields := templateFields(append([]*template.Template{task.CommandTemplate}, task.ArgsTemplates...)...)
+	// The immich user is only looked up when a template needs it
+	task.usesUser = slices.ContainsFunc(fields, func(field []string) bool { return field[0] == "user" })
+	values := sampleTemplateValues(task, fields)
+	for i, argTemplate := range task.ArgsTemplates {
+		var argBuf bytes.Buffer
+		err = argTemplate.Execute(&argBuf, values)
+		if err != nil {
+			err = fmt.Errorf("task %s unable to execute template for args[%d]: %v", task.Name, i, err)
+			return
+		}
+	}
+	if task.CommandTemplate != nil {
+		var cmdLine bytes.Buffer
+		err = task.CommandTemplate.Execute(&cmdLine, values)
+		if err != nil {
+			err = fmt.Errorf("task %s unable to execute template for command: %v", task.Name, err)
+			return
+		}
 	}
 
 	return
 }
 
+// Warnings Returns non fatal issues with the task definition
+func (task *Task) Warnings() (warnings []string) {
+	if task.Command != "" {
+		warnings = append(warnings, "command runs through a shell, quoting mistakes can lead to shell injection: use args instead")
+	}
+	if len(task.Extensions) == 0 {
+		warnings = append(warnings, "no extensions, the task will never run")
+	}
+	return
+}
+
+// DownloadTask Converts original downloads stored in one of MimeTypes to Format
+type DownloadTask struct {
+	Name          string   `mapstructure:"name"`
+	MimeTypes     []string `mapstructure:"mime_types"`
+	Format        string   `mapstructure:"format"`
+	Formats       []string `mapstructure:"formats"`
+	Args          []string `mapstructure:"args"`
+	Metadata      string   `mapstructure:"metadata"`
+	ArgsTemplates []*template.Template
+}
+
+func (dt *DownloadTask) Init() (err error) {
+	if len(dt.MimeTypes) == 0 {
+		return fmt.Errorf("download task %s: mime_types is required", dt.Name)
+	}
+	// formats lists the targets the client can negotiate, by preference. format is the default target
+	if len(dt.Formats) == 0 {
+		dt.Formats = []string{dt.Format}
+	} else if dt.Format == "" {
+		dt.Format = dt.Formats[0]
+	}
+	for _, format := range append(dt.Formats, dt.Format) {
+		if _, ok := imageFormats[format]; !ok {
+			return fmt.Errorf("download task %s: unknown format: %s", dt.Name, format)
+		}
+	}
+	if len(dt.Args) == 0 || strings.TrimSpace(dt.Args[0]) == "" {
+		return fmt.Errorf("download task %s: args[0] must be the program to run", dt.Name)
+	}
+	switch dt.Metadata {
+	case "":
+		dt.Metadata = MetadataExiftool
+	case MetadataExiftool, MetadataNone:
+	default:
+		return fmt.Errorf("download task %s: invalid metadata: %s", dt.Name, dt.Metadata)
+	}
+	values := map[string]any{
+		"input":     "/input",
+		"output":    "/output.jpg",
+		"format":    dt.Format,
+		"extension": "jpg",
+	}
+	dt.ArgsTemplates = make([]*template.Template, len(dt.Args))
+	for i, arg := range dt.Args {
+		dt.ArgsTemplates[i], err = parseTemplate("arg", arg)
+		if err != nil {
+			return fmt.Errorf("download task %s unable to parse args[%d]: %v", dt.Name, i, err)
+		}
+		var argBuf bytes.Buffer
+		if err = dt.ArgsTemplates[i].Execute(&argBuf, values); err != nil {
+			return fmt.Errorf("download task %s unable to execute template for args[%d]: %v", dt.Name, i, err)
+		}
+	}
+	return nil
+}
+
+func (dt *DownloadTask) command(values map[string]any) (*exec.Cmd, error) {
+	args := make([]string, len(dt.ArgsTemplates))
+	for i, argTemplate := range dt.ArgsTemplates {
+		var arg bytes.Buffer
+		if err := argTemplate.Execute(&arg, values); err != nil {
+			return nil, fmt.Errorf("unable to generate args[%d] to be Run: %w", i, err)
+		}
+		args[i] = arg.String()
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.Dir = path.Dir(configFile)
+	return cmd, nil
+}
+
 type Config struct {
-	Tasks []*Task `mapstructure:"tasks"`
+	Tasks         []*Task         `mapstructure:"tasks"`
+	DownloadTasks []*DownloadTask `mapstructure:"download_tasks"`
 }
 
 func NewConfig(configFile *string) (*Config, error) {
@@ -64,5 +226,22 @@ func NewConfig(configFile *string) (*Config, error) {
 		}
 	}
 
+	// Flag presets only apply to MIME types not handled by the tasks file
+	for _, preset := range downloadTaskPresets() {
+		configured := false
+		for _, dt := range c.DownloadTasks {
+			configured = configured || slices.ContainsFunc(preset.MimeTypes, func(m string) bool { return slices.Contains(dt.MimeTypes, m) })
+		}
+		if !configured {
+			c.DownloadTasks = append(c.DownloadTasks, preset)
+		}
+	}
+	for i := range c.DownloadTasks {
+		err = c.DownloadTasks[i].Init()
+		if err != nil {
+			return nil, fmt.Errorf("error validating config: %v", err)
+		}
+	}
+
 	return c, nil
 }
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+func downloadAndConvertImage(w http.ResponseWriter, r *http.Request, logger *customLogger, assetUUID string) (err error) {
+	logger.SetErrPrefix("download and convert")
+	var asset Asset
+	if asset, err = fetchAsset(r, assetUUID, logger); err != nil {
+		return
+	}
+	originalMimeType, _ := asset["originalMimeType"].(string)
+	downloadTask := findDownloadTask(originalMimeType)
+	if downloadTask == nil {
+		return errors.New("no conversion needed")
+	}
+	// The response depends on what the client supports, also when the original is proxied as is
+	w.Header().Add("Vary", "Accept, User-Agent")
+	format, convert := negotiateFormat(r.Header, originalMimeType, downloadTask)
+	if !convert {
+		return errors.New("client supports " + originalMimeType)
+	}
+	// Shared links can hide the checksum: without it the stored file is unknown, nothing can be cached or revalidated
+	checksum, _ := asset["checksum"].(string)
+	var cacheKey, etag string
+	if checksum != "" {
+		cacheKey = downloadCacheKey(checksum, downloadTask, format)
+		// The ETag only depends on the stored file and the conversion settings: revalidation doesn't need a conversion
+		etag = `"` + cacheKey[:32] + `"`
+	}
+	if etag != "" && etagMatch(r.Header.Get("If-None-Match"), etag) {
+		setDownloadHeaders(w.Header(), asset, format, etag)
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	// Download file and convert, or reuse a previous conversion of the same stored file
+	logger.Printf("converting to %s: %s", format, r.URL)
+	converted, release, err := convertCached(cacheKey, func() (string, error) {
+		return downloadAndConvert(r, logger, downloadTask, checksum, originalMimeType, format)
+	})
+	if err != nil {
+		return
+	}
+	defer release()
+	// Only set once the conversion is there: the proxy fallback must not describe the original as converted
+	setDownloadHeaders(w.Header(), asset, format, etag)
+	// A JPEG rebuilt from a lossless JXL can be proven to be the original file
+	if originalMimeType == "image/jxl" && format == "jpeg" {
+		if exact, err := isExactOriginal(converted, checksum); !logger.Error(err, "exact original") && exact {
+			w.Header().Set("X-IUO-Exact-Original", "true")
+		}
+	}
+	// Handles HEAD, Range, If-Range and If-Modified-Since
+	modTime, _ := time.Parse(time.RFC3339, fmt.Sprint(asset["fileModifiedAt"]))
+	http.ServeContent(w, r, "", modTime, converted)
+	return nil
+}
+
+// fetchAsset Gets the asset info from immich with the client credentials
+func fetchAsset(r *http.Request, assetUUID string, logger *customLogger) (asset Asset, err error) {
+	var req *http.Request
+	var resp *http.Response
+	// Query holds the shared link key or slug: guests are authenticated by it
+	if req, err = http.NewRequest("GET", upstreamURL+"/api/assets/"+assetUUID+"?"+r.URL.RawQuery, nil); logger.Error(err, "new GET") {
+		return
+	}
+	req.Header = upstreamDownloadHeader(r.Header)
+	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
+		return
+	}
+	defer resp.Body.Close()
+	bodyReader, _ := getBodyWriterReaderHTTP(nil, resp)
+	defer bodyReader.Close()
+	var jsonBuf []byte
+	if jsonBuf, err = io.ReadAll(bodyReader); logger.Error(err, "resp read") {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("not HTTP ok")
+	}
+	if err = json.Unmarshal(jsonBuf, &asset); logger.Error(err, "json unmarshal") {
+		return
+	}
+	return asset, nil
+}
+
+// upstreamDownloadHeader Conditional and range headers are handled by IUO on the converted file, the whole original must be downloaded
+func upstreamDownloadHeader(header http.Header) http.Header {
+	header = header.Clone()
+	for _, key := range []string{"Range", "If-Range", "If-None-Match", "If-Modified-Since", "If-Match", "If-Unmodified-Since"} {
+		header.Del(key)
+	}
+	return header
+}
+
+// setDownloadHeaders Describes the converted file, its name matches the one advertised by toOriginalAsset
+func setDownloadHeaders(header http.Header, asset Asset, format, etag string) {
+	imageFormat := imageFormats[format]
+	header.Set("Content-Type", imageFormat.MimeType)
+	header.Set("Cache-Control", "private, max-age=86400, no-transform")
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if originalFileName, ok := asset["originalFileName"].(string); ok {
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": originalFileName + imageFormat.Extension}))
+	}
+}
+
+// etagMatch Weak comparison of If-None-Match with the ETag
+func etagMatch(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// downloadAndConvert Downloads the original requested by the client and converts it, returns the path of the converted file
+func downloadAndConvert(r *http.Request, logger *customLogger, downloadTask *DownloadTask, checksum, mimeType, format string) (converted string, err error) {
+	var req *http.Request
+	var resp *http.Response
+	var blob *os.File
+	if req, err = http.NewRequest("GET", upstreamURL+r.URL.String(), nil); logger.Error(err, "new GET") {
+		return
+	}
+	req.Header = upstreamDownloadHeader(r.Header)
+	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", errors.New("not HTTP ok")
+	}
+	if blob, err = os.CreateTemp("", "blob-*"); logger.Error(err, "blob create") {
+		return
+	}
+	defer func() { blob.Close(); _ = os.Remove(blob.Name()) }()
+	if _, err = io.Copy(blob, resp.Body); logger.Error(err, "blob copy") {
+		return
+	}
+	var output []byte
+	if converted, output, err = downloadTask.Convert(blob.Name(), checksum, mimeType, format, logger); logger.Error(err, downloadTask.Name) {
+		return
+	}
+	logger.Printf("conversion complete: %s", strings.ReplaceAll(string(output), "\n", " - "))
+	return converted, nil
+}
+
+// downloadCacheKey Conversions are cached by stored checksum and every setting affecting the result
+func downloadCacheKey(checksum string, downloadTask *DownloadTask, format string) string {
+	return cacheKey(checksum, downloadTask.Name, strings.Join(downloadTask.Args, "\x00"), format, downloadTask.Metadata)
+}
+
+// prewarmDownloadCache Converts a file just uploaded to immich, so the first download is served from the cache
+func prewarmDownloadCache(file, checksum string, logger *customLogger) {
+	head, err := readFileHead(file, sniffLen)
+	if err != nil {
+		return
+	}
+	mimeType := detectMimeType(head)
+	downloadTask := findDownloadTask(mimeType)
+	if downloadCache == nil || downloadTask == nil || checksum == "" {
+		return
+	}
+	_, release, err := convertLocalFile(file, checksum, mimeType, downloadTask, downloadTask.Format, logger)
+	if !logger.Error(err, "prewarm download cache") {
+		release()
+		logger.Printf("download cache prewarmed: %s", downloadTask.Format)
+	}
+}
+
+// convertLocalFile Converts a file already on disk, through the cache if enabled and the checksum is known. release closes the converted file
+func convertLocalFile(file, checksum, mimeType string, downloadTask *DownloadTask, format string, logger *customLogger) (converted *os.File, release func(), err error) {
+	var key string
+	if checksum != "" {
+		key = downloadCacheKey(checksum, downloadTask, format)
+	}
+	return convertCached(key, func() (string, error) {
+		converted, _, err := downloadTask.Convert(file, checksum, mimeType, format, logger)
+		return converted, err
+	})
+}
+
+// convertCached Returns the converted file opened, convert runs unless the download cache has the key. Empty keys aren't cached.
+// release closes the converted file and removes the output of convert, the cache keeps its own copy
+func convertCached(key string, convert func() (string, error)) (converted *os.File, release func(), err error) {
+	var output string
+	run := func() (string, error) {
+		var err error
+		output, err = convert()
+		return output, err
+	}
+	if downloadCache != nil && key != "" {
+		converted, err = downloadCache.Do(key, run)
+	} else if _, err = run(); err == nil {
+		converted, err = os.Open(output)
+	}
+	release = func() {
+		if converted != nil {
+			_ = converted.Close()
+		}
+		if output != "" {
+			_ = os.Remove(output)
+		}
+	}
+	if err != nil {
+		release()
+		return nil, nil, err
+	}
+	return converted, release, nil
+}
+
+// Convert Runs the download task on the input file, after checking its content matches the expected MIME type.
+// checksum is the stored file checksum, used to verify JPEG reconstructions, empty if unknown.
+// Returns the path of the converted file, next to the input, and the command output
+func (dt *DownloadTask) Convert(input, checksum, mimeType, format string, logger *customLogger) (converted string, output []byte, err error) {
+	head, err := readFileHead(input, sniffLen)
+	if err != nil {
+		return "", nil, fmt.Errorf("read: %w", err)
+	}
+	if detected := detectMimeType(head); !sameImageFamily(detected, mimeType) {
+		return "", nil, fmt.Errorf("bad %s signature: detected %s", mimeType, detected)
+	}
+	imageFormat := imageFormats[format]
+	converted = input + imageFormat.Extension
+	cmd, err := dt.command(map[string]any{
+		"input":     input,
+		"output":    converted,
+		"format":    format,
+		"extension": strings.TrimPrefix(imageFormat.Extension, "."),
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if output, err = cmd.CombinedOutput(); err != nil {
+		_ = os.Remove(converted)
+		return "", output, fmt.Errorf("%w: %s", err, output)
+	}
+	reconstruction := format == "jpeg" && hasJPEGReconstruction(input)
+	if reconstruction {
+		// The stored JXL was made from a JPEG: the conversion must be the original file, metadata included
+		exact, err := isExactOriginalFile(converted, checksum)
+		switch {
+		case err != nil:
+			logger.Error(err, "exact original")
+		case exact:
+			return converted, append(output, "\nexact original"...), nil
+		default:
+			if original, ok := originalChecksum(checksum); ok {
+				logger.Printf("ERROR: %s: reconstructed JPEG doesn't match the original checksum %s of %s, the stored file may be corrupted", dt.Name, original, checksum)
+			}
+		}
+	}
+	// A reconstructed JPEG already has the original metadata, rewriting it would make it differ from the original
+	if _, exiftoolErr := exiftoolPath(); dt.Metadata == MetadataExiftool && exiftoolErr == nil && !reconstruction {
+		// Converters can drop EXIF, GPS and the color profile. A conversion without metadata is still better than no conversion
+		if lost, err := copyMetadata(input, converted); !logger.Error(err, "copy metadata") {
+			if len(lost) > 0 {
+				logger.Printf("WARNING: %s: %s", dt.Name, metadataSummary(lost))
+			}
+			output = append(output, "\n"+metadataSummary(lost)...)
+		}
+	}
+	return converted, output, nil
+}
+
+// isExactOriginal Reports whether the converted file is the original replaced by the stored one, false if the original checksum is unknown.
+// The file offset is left untouched
+func isExactOriginal(converted *os.File, checksum string) (bool, error) {
+	original, ok := originalChecksum(checksum)
+	if !ok {
+		return false, nil
+	}
+	hasher := sha1.New()
+	if _, err := io.Copy(hasher, io.NewSectionReader(converted, 0, math.MaxInt64)); err != nil {
+		return false, err
+	}
+	return encodeChecksum(hasher) == original, nil
+}
+
+// isExactOriginalFile isExactOriginal of the file at path
+func isExactOriginalFile(converted, checksum string) (bool, error) {
+	file, err := os.Open(converted)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	return isExactOriginal(file, checksum)
+}
+
+// findDownloadTask Returns the first download task converting the MIME type, nil if it must be served as is
+func findDownloadTask(mimeType string) *DownloadTask {
+	if config == nil || mimeType == "" {
+		return nil
+	}
+	for _, dt := range config.DownloadTasks {
+		for _, m := range dt.MimeTypes {
+			if m == mimeType {
+				return dt
+			}
+		}
+	}
+	return nil
+}
+
+// jpegReconstructionTask Rebuilds the JPEG a lossless JXL was made from, used to verify uploads
+var jpegReconstructionTask = sync.OnceValue(func() *DownloadTask {
+	dt := &DownloadTask{
+		Name:      "jxl-to-jpg-reconstruction",
+		MimeTypes: []string{"image/jxl"},
+		Format:    "jpeg",
+		Args:      []string{"djxl", "{{.input}}", "{{.output}}"},
+		Metadata:  MetadataNone,
+	}
+	_ = dt.Init()
+	return dt
+})
+
+// downloadTaskPresets Download tasks enabled by the -download_jpg_from_* flags
+func downloadTaskPresets() (presets []*DownloadTask) {
+	if downloadJpgFromJxl {
+		presets = append(presets, &DownloadTask{
+			Name:      "jxl-to-jpg",
+			MimeTypes: []string{"image/jxl"},
+			Format:    "jpeg",
+			Args:      []string{"djxl", "{{.input}}", "{{.output}}"},
+		})
+	}
+	if downloadJpgFromAvif {
+		presets = append(presets, &DownloadTask{
+			Name:      "avif-to-jpg",
+			MimeTypes: []string{"image/avif"},
+			Format:    "jpeg",
+			Args:      []string{"avifdec", "-q", "95", "{{.input}}", "{{.output}}"},
+		})
+	}
+	return
+}
@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runExport Downloads the library to a directory in the original formats, for offline backups.
+// Files processed by IUO are replaced by their original: from the vault if archived, else converted back like downloads are.
+// Files are written to <dir>/<user email>/<year>/<month>/<original filename>
+func runExport(args []string) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dir := flags.String("dir", "", "Directory the library is exported to")
+	filter := flags.String("users", "", "Comma separated emails or ids of the users to export. Default: all the -api_key users")
+	full := flags.Bool("full", false, "Export every asset, not only the ones updated since the last export")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *dir == "" {
+		return errors.New("the -dir flag is required")
+	}
+	var err error
+	if config, err = NewConfig(&configFile); err != nil {
+		return fmt.Errorf("error loading config file: %w", err)
+	}
+	users, err := initCommand()
+	if err != nil {
+		return err
+	}
+	if vaultLocation != "" {
+		if vault, err = newVault(vaultLocation); err != nil {
+			return fmt.Errorf("vault: %w", err)
+		}
+	}
+	if err = os.MkdirAll(*dir, 0755); err != nil {
+		return err
+	}
+	statePath := filepath.Join(*dir, ".iuo-export")
+	lastRun, paths, err := readExportState(statePath)
+	if err != nil {
+		return err
+	}
+	stateFile, err := os.OpenFile(statePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer stateFile.Close()
+
+	exported, exact, failed := 0, 0, 0
+	for _, user := range selectUsers(users, *filter) {
+		logger := newCustomLogger(baseLogger, user.Email+": ")
+		started := time.Now()
+		filters := map[string]any{}
+		if since, ok := lastRun[user.ID]; ok && !*full {
+			filters["updatedAfter"] = since.Format(time.RFC3339Nano)
+			logger.Printf("exporting assets updated after %s", since.Format(time.RFC3339))
+		}
+		userFailed := 0
+		for page := 1; page > 0; {
+			var assets []Asset
+			if assets, page, err = searchAssetsPage(user.Header, filters, page, 250); err != nil {
+				return fmt.Errorf("%s: unable to list assets: %w", user.Email, err)
+			}
+			for _, asset := range assets {
+				assetID := fmt.Sprint(asset["id"])
+				rel, isOriginal, err := exportAsset(user, asset, *dir, paths[assetID], logger)
+				if err != nil {
+					logger.Printf("%s (%s): %v", asset["originalFileName"], assetID, err)
+					userFailed++
+					continue
+				}
+				exported++
+				if isOriginal {
+					exact++
+				}
+				if rel != paths[assetID] {
+					paths[assetID] = rel
+					if _, err = fmt.Fprintf(stateFile, "path %s %s\n", assetID, rel); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		failed += userFailed
+		// Failed assets are exported again next time
+		if userFailed == 0 {
+			if _, err = fmt.Fprintf(stateFile, "run %s %s\n", user.ID, started.UTC().Format(time.RFC3339Nano)); err != nil {
+				return err
+			}
+		}
+	}
+	log.Printf("%d assets exported to %s, %d processed by IUO restored to the exact original, %d failed", exported, *dir, exact, failed)
+	if failed > 0 {
+		return fmt.Errorf("%d assets failed, run the command again to retry", failed)
+	}
+	return nil
+}
+
+// exportAsset Writes the asset to the export directory, replacing its previous export. Returns the file path relative to dir
+// and whether the file is the exact original replaced by a file processed by IUO
+func exportAsset(user *commandUser, asset Asset, dir, previous string, logger *customLogger) (rel string, isOriginal bool, err error) {
+	assetID := fmt.Sprint(asset["id"])
+	checksum, _ := asset["checksum"].(string)
+	filename := path.Base(fmt.Sprint(asset["originalFileName"]))
+	original, processed := originalChecksum(checksum)
+	mapLock.RLock()
+	location := fakeToVault[checksum]
+	mapLock.RUnlock()
+
+	// Written next to the destination, then renamed
+	temp, err := os.CreateTemp(dir, ".export-*")
+	if err != nil {
+		return "", false, err
+	}
+	defer func() { temp.Close(); _ = os.Remove(temp.Name()) }()
+	output := temp.Name()
+	if processed && location != "" && vault != nil {
+		var file *os.File
+		if file, filename, err = fetchVaultOriginal(checksumEntry{checksum, original, location}); err != nil {
+			return "", false, fmt.Errorf("vault: %w", err)
+		}
+		_, err = io.Copy(temp, file)
+		file.Close()
+		_ = os.Remove(file.Name())
+		if err != nil {
+			return "", false, err
+		}
+	} else {
+		if err = downloadAsset(user.Header, assetID, temp); err != nil {
+			return "", false, err
+		}
+		if processed {
+			var converted, format string
+			if converted, format, err = convertExport(output, checksum, logger); err != nil {
+				return "", false, err
+			}
+			if converted != output {
+				defer os.Remove(converted)
+				output = converted
+				filename = strings.TrimSuffix(filename, path.Ext(filename)) + imageFormats[format].Extension
+			}
+		}
+	}
+	if processed {
+		sum, err := fileChecksum(output)
+		if err != nil {
+			return "", false, err
+		}
+		isOriginal = sum == original
+	}
+
+	rel = previous
+	if rel == "" {
+		if rel, err = exportPath(dir, user.Email, asset, filename); err != nil {
+			return "", false, err
+		}
+	}
+	name := filepath.Join(dir, rel)
+	if err = os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", false, err
+	}
+	if err = os.Rename(output, name); err != nil {
+		return "", false, err
+	}
+	_ = os.Chmod(name, 0644)
+	if modTime, err := time.Parse(time.RFC3339, fmt.Sprint(asset["fileModifiedAt"])); err == nil {
+		_ = os.Chtimes(name, modTime, modTime)
+	}
+	if processed && !isOriginal {
+		logger.Printf("exported: %s (converted, not the original file %s)", rel, original)
+	} else {
+		logger.Printf("exported: %s", rel)
+	}
+	return rel, isOriginal, nil
+}
+
+// downloadAsset Downloads the stored file of the asset
+func downloadAsset(header http.Header, assetID string, file *os.File) error {
+	resp, err := immichRequest("GET", "/api/assets/"+assetID+"/original", header, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("download original: %s", resp.Status)
+	}
+	_, err = io.Copy(file, resp.Body)
+	return err
+}
+
+// convertExport Converts a file processed by IUO back to the format of the original: a JXL made from a JPEG is rebuilt bit-exact,
+// other files are converted by their download task. Returns the input if there's no conversion
+func convertExport(input, checksum string, logger *customLogger) (converted, format string, err error) {
+	head, err := readFileHead(input, sniffLen)
+	if err != nil {
+		return "", "", err
+	}
+	mimeType := detectMimeType(head)
+	downloadTask := findDownloadTask(mimeType)
+	if mimeType == "image/jxl" && hasJPEGReconstruction(input) {
+		downloadTask = jpegReconstructionTask()
+	}
+	if downloadTask == nil {
+		return input, "", nil
+	}
+	if converted, _, err = downloadTask.Convert(input, checksum, mimeType, downloadTask.Format, logger); err != nil {
+		return "", "", fmt.Errorf("%s: %w", downloadTask.Name, err)
+	}
+	return converted, downloadTask.Format, nil
+}
+
+// exportPath Dated path of a new export: <user email>/<year>/<month>/<filename>, the asset id is appended to the name if it's taken
+func exportPath(dir, email string, asset Asset, filename string) (string, error) {
+	date, err := time.Parse(time.RFC3339, fmt.Sprint(asset["localDateTime"]))
+	if err != nil {
+		if date, err = time.Parse(time.RFC3339, fmt.Sprint(asset["fileCreatedAt"])); err != nil {
+			return "", fmt.Errorf("unknown asset date: %w", err)
+		}
+	}
+	filename = filepath.Base(filename)
+	folder := filepath.Join(filepath.Base(email), date.Format("2006"), date.Format("01"))
+	rel := filepath.Join(folder, filename)
+	if _, err = os.Stat(filepath.Join(dir, rel)); err == nil {
+		ext := path.Ext(filename)
+		rel = filepath.Join(folder, strings.TrimSuffix(filename, ext)+"_"+fmt.Sprint(asset["id"])+ext)
+	}
+	return rel, nil
+}
+
+// readExportState Reads the export state file: "run <user id> <time>" lines record the start of the last complete export of a user,
+// the next export only fetches assets updated after it. "path <asset id> <path>" lines record where an asset was written, an updated asset replaces its own file
+func readExportState(name string) (lastRun map[string]time.Time, paths map[string]string, err error) {
+	lastRun, paths = map[string]time.Time{}, map[string]string{}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return lastRun, paths, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		kind, rest, _ := strings.Cut(scanner.Text(), " ")
+		key, value, ok := strings.Cut(rest, " ")
+		if !ok {
+			continue
+		}
+		switch kind {
+		case "run":
+			if t, err := time.Parse(time.RFC3339Nano, value); err == nil {
+				lastRun[key] = t
+			}
+		case "path":
+			paths[key] = value
+		}
+	}
+	return lastRun, paths, scanner.Err()
+}
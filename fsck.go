@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"strings"
+)
+
+// fsckAsset An asset of a command user
+type fsckAsset struct {
+	user  *commandUser
+	asset Asset
+}
+
+// runFsck Cross-checks the checksums file with the assets of every -api_key user:
+//   - orphaned records: no asset has the stored file anymore
+//   - duplicates: a user has several assets of the same original, the app sees the same checksum twice
+//   - missing records: lossless JXL assets made from a JPEG without a record, the app would upload the JPEG again
+//
+// Assets of users without an API key are unknown, their records are reported as orphaned but only removed with -remove_orphans
+func runFsck(args []string) error {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	fix := flags.Bool("fix", false, "Remove orphaned records of the scanned users' assets and add missing records")
+	removeOrphans := flags.Bool("remove_orphans", false, "With -fix, also remove orphaned records of unknown assets. Only if the API keys of all the users are passed")
+	trashDuplicates := flags.Bool("trash_duplicates", false, "Move the newer duplicates to the immich trash, the oldest upload is kept")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	users, err := initCommand()
+	if err != nil {
+		return err
+	}
+	logger := newCustomLogger(baseLogger, "fsck: ")
+
+	// Trashed assets can still be restored, their records are needed
+	byChecksum := map[string][]fsckAsset{}
+	scanned := map[string]bool{}
+	var unmapped []fsckAsset
+	for _, user := range users {
+		for page := 1; page > 0; {
+			var assets []Asset
+			if assets, page, err = searchAssetsPage(user.Header, map[string]any{"withDeleted": true}, page, 1000); err != nil {
+				return fmt.Errorf("%s: unable to list assets: %w", user.Email, err)
+			}
+			for _, asset := range assets {
+				checksum, _ := asset["checksum"].(string)
+				byChecksum[checksum] = append(byChecksum[checksum], fsckAsset{user, asset})
+				scanned[fmt.Sprint(asset["id"])] = true
+				if _, ok := originalChecksum(checksum); !ok && asset["originalMimeType"] == "image/jxl" {
+					unmapped = append(unmapped, fsckAsset{user, asset})
+				}
+			}
+		}
+	}
+
+	// An orphaned record is only known to be stale if its asset belongs to a scanned user: the asset has another file now.
+	// Other assets may belong to a user without an API key
+	records, err := readChecksumsFile()
+	if err != nil {
+		return err
+	}
+	orphans := map[checksumRecord]bool{}
+	unknownOrphans := 0
+	for _, record := range records {
+		key := checksumRecord{Fake: record.Fake, AssetID: record.AssetID}
+		if len(byChecksum[record.Fake]) > 0 || orphans[key] {
+			continue
+		}
+		orphans[key] = true
+		switch {
+		case record.AssetID == "":
+			log.Printf("orphaned: %s -> %s, no scanned asset has the stored file, the record has no asset id", record.Fake, record.Original)
+			unknownOrphans++
+		case scanned[record.AssetID]:
+			log.Printf("orphaned: %s -> %s, asset %s has another file", record.Fake, record.Original, record.AssetID)
+		default:
+			log.Printf("orphaned: %s -> %s, no scanned asset has the stored file, asset %s is unknown", record.Fake, record.Original, record.AssetID)
+			unknownOrphans++
+		}
+	}
+
+	duplicates := fsckDuplicates(byChecksum)
+	for _, group := range duplicates {
+		names := make([]string, len(group))
+		for i, a := range group {
+			names[i] = fmt.Sprintf("%s (%s)", a.asset["originalFileName"], a.asset["id"])
+		}
+		log.Printf("duplicate: %s has the same original in %s, -trash_duplicates keeps %s", group[0].user.Email, strings.Join(names, ", "), names[0])
+	}
+
+	missing := map[string]string{}
+	missingAssets := map[string]string{}
+	for _, a := range unmapped {
+		checksum, _ := a.asset["checksum"].(string)
+		if _, ok := missing[checksum]; ok {
+			continue
+		}
+		original, err := reconstructedChecksum(a, logger)
+		if err != nil {
+			logger.Printf("%s (%s): %v", a.asset["originalFileName"], a.asset["id"], err)
+			continue
+		}
+		if original != "" {
+			log.Printf("missing: %s -> %s, %s (%s) is a JPEG converted to lossless JXL", checksum, original, a.asset["originalFileName"], a.asset["id"])
+			missing[checksum] = original
+			missingAssets[checksum] = fmt.Sprint(a.asset["id"])
+		}
+	}
+
+	log.Printf("%d records, %d orphaned (%d of unknown assets), %d duplicates, %d missing", len(records), len(orphans), unknownOrphans, len(duplicates), len(missing))
+	if !*fix && !*trashDuplicates {
+		if problems := len(orphans) + len(duplicates) + len(missing); problems > 0 {
+			return fmt.Errorf("%d problems found, run with -fix to fix the records and -trash_duplicates to trash the duplicates", problems)
+		}
+		return nil
+	}
+
+	if *fix {
+		removed, err := removeChecksumRecords(func(record []string) bool {
+			parsed, ok := parseChecksumRecord(record)
+			if !ok || !orphans[checksumRecord{Fake: parsed.Fake, AssetID: parsed.AssetID}] {
+				return false
+			}
+			return *removeOrphans || parsed.AssetID != "" && scanned[parsed.AssetID]
+		})
+		if err != nil {
+			return fmt.Errorf("unable to update the checksums file: %w", err)
+		}
+		if unknownOrphans > 0 && !*removeOrphans {
+			log.Printf("%d orphaned records of unknown assets kept, pass -remove_orphans with the API keys of all the users to remove them", unknownOrphans)
+		}
+		for fake, original := range missing {
+			addChecksums(fake, original, "", missingAssets[fake], "")
+		}
+		log.Printf("%d orphaned records removed, %d missing records added", len(removed), len(missing))
+	}
+	if !*trashDuplicates {
+		if len(duplicates) > 0 {
+			return fmt.Errorf("%d duplicates left, run with -trash_duplicates to trash them", len(duplicates))
+		}
+		return nil
+	}
+	failed := 0
+	for _, group := range duplicates {
+		// The first uploaded asset is kept, the trash can be emptied or restored from immich
+		var ids []string
+		for _, a := range group[1:] {
+			ids = append(ids, fmt.Sprint(a.asset["id"]))
+		}
+		body, _ := json.Marshal(map[string]any{"ids": ids, "force": false})
+		if err = immichJSON("DELETE", "/api/assets", group[0].user.Header, bytes.NewReader(body), nil); err != nil {
+			logger.Printf("%s: unable to trash duplicates %s: %v", group[0].user.Email, strings.Join(ids, ", "), err)
+			failed++
+			continue
+		}
+		log.Printf("%s: trashed duplicates %s, kept %s", group[0].user.Email, strings.Join(ids, ", "), group[0].asset["id"])
+	}
+	log.Printf("trashed %d duplicates", len(duplicates)-failed)
+	if failed > 0 {
+		return fmt.Errorf("%d duplicates couldn't be trashed", failed)
+	}
+	return nil
+}
+
+// fsckDuplicates Groups of assets of the same user with the same original, at least one processed by IUO. Oldest upload first
+func fsckDuplicates(byChecksum map[string][]fsckAsset) (duplicates [][]fsckAsset) {
+	type userOriginal struct{ userID, original string }
+	groups := map[userOriginal][]fsckAsset{}
+	processed := map[userOriginal]bool{}
+	for checksum, assets := range byChecksum {
+		original, ok := originalChecksum(checksum)
+		if !ok {
+			original = checksum
+		}
+		for _, a := range assets {
+			if trashed, _ := a.asset["isTrashed"].(bool); trashed {
+				continue
+			}
+			key := userOriginal{a.user.ID, original}
+			groups[key] = append(groups[key], a)
+			processed[key] = processed[key] || ok
+		}
+	}
+	for key, group := range groups {
+		if len(group) < 2 || !processed[key] {
+			continue
+		}
+		slices.SortFunc(group, func(a, b fsckAsset) int {
+			return strings.Compare(fmt.Sprint(a.asset["createdAt"]), fmt.Sprint(b.asset["createdAt"]))
+		})
+		duplicates = append(duplicates, group)
+	}
+	slices.SortFunc(duplicates, func(a, b []fsckAsset) int {
+		return strings.Compare(fmt.Sprint(a[0].asset["id"]), fmt.Sprint(b[0].asset["id"]))
+	})
+	return
+}
+
+// reconstructedChecksum Checksum of the JPEG a lossless JXL asset was made from, empty if it wasn't made from a JPEG
+func reconstructedChecksum(a fsckAsset, logger *customLogger) (string, error) {
+	file, err := os.CreateTemp("", "fsck-*")
+	if err != nil {
+		return "", err
+	}
+	defer func() { file.Close(); _ = os.Remove(file.Name()) }()
+	if err = downloadAsset(a.user.Header, fmt.Sprint(a.asset["id"]), file); err != nil {
+		return "", err
+	}
+	if !hasJPEGReconstruction(file.Name()) {
+		return "", nil
+	}
+	converted, _, err := jpegReconstructionTask().Convert(file.Name(), "", "image/jxl", "jpeg", logger)
+	if err != nil {
+		return "", fmt.Errorf("unable to rebuild the JPEG: %w", err)
+	}
+	defer os.Remove(converted)
+	return fileChecksum(converted)
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var deletedLock sync.Mutex
+
+// deletedAssets Permanently deleted assets having checksums records, by deletion time. Kept in <checksums_file>.gc until collected
+var deletedAssets = map[string]time.Time{}
+
+// deletingAssets Returns the ids of the assets the request permanently deletes: DELETE /api/assets with force, or emptying the trash.
+// Assets moved to the trash can still be restored, they're collected when immich reports their deletion
+func deletingAssets(r *http.Request, logger *customLogger) (ids []string) {
+	switch {
+	case isAssetsDelete(r):
+		body, err := io.ReadAll(r.Body)
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		if logger.Error(err, "checksums gc: read body") {
+			return nil
+		}
+		var request struct {
+			IDs   []string `json:"ids"`
+			Force bool     `json:"force"`
+		}
+		if json.Unmarshal(body, &request) != nil || !request.Force {
+			return nil
+		}
+		return request.IDs
+	case isTrashEmpty(r):
+		// The trash is listed before immich empties it
+		filters := map[string]any{"withDeleted": true, "trashedBefore": time.Now().UTC().Format(time.RFC3339Nano)}
+		for page := 1; page > 0; {
+			assets, next, err := searchAssetsPage(r.Header, filters, page, 1000)
+			if logger.Error(err, "checksums gc: list trash") {
+				return ids
+			}
+			for _, asset := range assets {
+				ids = append(ids, fmt.Sprint(asset["id"]))
+			}
+			page = next
+		}
+	}
+	return ids
+}
+
+// observeDeletedAssets Schedules the removal of the checksums records of deleted assets, after the grace period
+func observeDeletedAssets(ids []string, logger *customLogger) {
+	mapLock.RLock()
+	var known []string
+	for _, id := range ids {
+		if _, ok := assetToFake[id]; ok {
+			known = append(known, id)
+		}
+	}
+	mapLock.RUnlock()
+	if len(known) == 0 {
+		return
+	}
+	deletedLock.Lock()
+	defer deletedLock.Unlock()
+	// The file is shared by the instances sharing the checksums file
+	unlock, err := lockChecksums(true)
+	if logger.Error(err, "checksums gc") {
+		return
+	}
+	defer unlock()
+	file, err := os.OpenFile(checksumsFile+".gc", os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if logger.Error(err, "checksums gc") {
+		return
+	}
+	defer file.Close()
+	now := time.Now()
+	for _, id := range known {
+		if _, ok := deletedAssets[id]; ok {
+			continue
+		}
+		deletedAssets[id] = now
+		_, _ = fmt.Fprintf(file, "%s %s\n", id, now.UTC().Format(time.RFC3339))
+		logger.Printf("checksums gc: asset %s deleted, records removed after %s", id, checksumsGCGrace)
+	}
+}
+
+// loadDeletedAssets Reads the deletions not collected before the last exit
+func loadDeletedAssets() error {
+	file, err := os.Open(checksumsFile + ".gc")
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	deletedLock.Lock()
+	defer deletedLock.Unlock()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		id, deleted, _ := strings.Cut(scanner.Text(), " ")
+		if t, err := time.Parse(time.RFC3339, deleted); err == nil {
+			deletedAssets[id] = t
+		}
+	}
+	return scanner.Err()
+}
+
+// collectChecksums Removes the checksums records of the assets deleted for longer than the grace period, checks regularly
+func collectChecksums() {
+	for {
+		time.Sleep(min(checksumsGCGrace, time.Hour))
+		deletedLock.Lock()
+		expired := map[string]bool{}
+		for id, deleted := range deletedAssets {
+			if time.Since(deleted) >= checksumsGCGrace {
+				expired[id] = true
+			}
+		}
+		deletedLock.Unlock()
+		if len(expired) == 0 {
+			continue
+		}
+		removed, err := removeChecksumRecords(func(record []string) bool { return len(record) > 3 && expired[record[3]] })
+		if err != nil {
+			log.Printf("checksums gc: unable to update the checksums file: %v", err)
+			continue
+		}
+		for _, record := range removed {
+			log.Printf("checksums gc: removed %s -> %s of deleted asset %s", record[0], record[1], record[3])
+		}
+		mapLock.RLock()
+		forgotten := map[string]bool{}
+		for _, record := range removed {
+			if _, ok := fakeToOriginalChecksum[record[0]]; !ok {
+				forgotten[record[0]] = true
+			}
+		}
+		mapLock.RUnlock()
+		log.Printf("checksums gc: %d records of %d deleted assets removed, %d stored files forgotten", len(removed), len(expired), len(forgotten))
+
+		deletedLock.Lock()
+		for id := range expired {
+			delete(deletedAssets, id)
+		}
+		err = forgetDeletedAssets(expired)
+		deletedLock.Unlock()
+		if err != nil {
+			log.Printf("checksums gc: %v", err)
+		}
+	}
+}
+
+// forgetDeletedAssets Removes the collected assets from the deletions file, deletions observed by other instances are kept
+func forgetDeletedAssets(collected map[string]bool) error {
+	unlock, err := lockChecksums(true)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+	data, err := os.ReadFile(checksumsFile + ".gc")
+	if err != nil {
+		return err
+	}
+	var lines strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		if id, _, _ := strings.Cut(line, " "); line != "" && !collected[id] {
+			lines.WriteString(line + "\n")
+		}
+	}
+	temp := checksumsFile + ".gc.tmp"
+	if err = os.WriteFile(temp, []byte(lines.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(temp, checksumsFile+".gc")
+}
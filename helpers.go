@@ -10,6 +10,7 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/exec"
 	"path/filepath"
 	"regexp"
 	"strings"
@@ -49,8 +50,30 @@ func isAssetView(r *http.Request) bool {
 
 func isOriginalDownloadPath(r *http.Request) (bool, []string) {
 	re := regexp.MustCompile(`^/api/assets/([a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12})/original$`)
-	matches := re.FindStringSubmatch(r.URL.String())
-	return r.Method == "GET" && len(matches) == 2, matches
+	matches := re.FindStringSubmatch(r.URL.Path)
+	return (r.Method == "GET" || r.Method == "HEAD") && len(matches) == 2, matches
+}
+
+func isVideoDownloadPath(r *http.Request) (bool, []string) {
+	re := regexp.MustCompile(`^/api/assets/([a-z0-9]{8}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{4}-[a-z0-9]{12})/(original|video/playback)$`)
+	matches := re.FindStringSubmatch(r.URL.Path)
+	return (r.Method == "GET" || r.Method == "HEAD") && len(matches) == 3, matches
+}
+
+func isDownloadArchive(r *http.Request) bool {
+	return r.Method == "POST" && r.URL.Path == "/api/download/archive"
+}
+
+func isAssetsDelete(r *http.Request) bool {
+	return r.Method == "DELETE" && r.URL.Path == "/api/assets"
+}
+
+func isTrashEmpty(r *http.Request) bool {
+	return r.Method == "POST" && r.URL.Path == "/api/trash/empty"
+}
+
+func isSharedLink(r *http.Request) bool {
+	return r.Method == "GET" && r.URL.Path == "/api/shared-links/me"
 }
 
 func replaceAllBytes(byteSlice []byte, old []byte, new []byte) []byte {
@@ -100,6 +123,22 @@ func isValidFilename(s string) bool {
 	return re.MatchString(s)
 }
 
+// shellQuote Quotes s for a POSIX shell, safe strings are returned as is
+func shellQuote(s string) string {
+	if s != "" && regexp.MustCompile(`^[a-zA-Z0-9._/=:,+@%-]+$`).MatchString(s) {
+		return s
+	}
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func shellJoin(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		quoted[i] = shellQuote(arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
 func printVersion() string {
 	return fmt.Sprintf("immich-upload-optimizer %s, commit %s, built at %s", version, commit, date)
 }
@@ -123,6 +162,21 @@ func validateInput() {
 	if err != nil {
 		log.Fatalf("error loading config file: %v", err)
 	}
+	if _, ok := videoEncoderArgs[downloadVideoCodec]; downloadVideoCodec != "" && !ok {
+		log.Fatalf("invalid download_video_codec: %s", downloadVideoCodec)
+	}
+	if downloadVideoConcurrency < 1 {
+		log.Fatal("download_video_concurrency must be at least 1")
+	}
+	videoSemaphore = make(chan struct{}, downloadVideoConcurrency)
+	if _, err = exec.LookPath("ffmpeg"); downloadVideoCodec != "" && err != nil {
+		log.Printf("videos won't be transcoded on download: %v", err)
+	}
+	for _, downloadTask := range config.DownloadTasks {
+		if _, err = exiftoolPath(); downloadTask.Metadata == MetadataExiftool && err != nil {
+			log.Printf("download task %s: metadata won't be copied: %v", downloadTask.Name, err)
+		}
+	}
 }
 
 func removeAllContents(dir string) error {
@@ -206,3 +260,19 @@ func getBodyWriterReaderHTTP(w *http.ResponseWriter, resp *http.Response) (bodyR
 	}
 	return
 }
+
+// statusRecorder Remembers the status code written to the client
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	sr.status = status
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap Lets http.ResponseController flush the proxied response
+func (sr *statusRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
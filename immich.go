@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"strconv"
+)
+
+// immichRequest Sends a request to immich authenticated with the client headers (cookie, authorization or api key)
+func immichRequest(method, apiPath string, header http.Header, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, upstreamURL+apiPath, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = immichAuthHeader(header)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	return getHTTPclient().Do(req)
+}
+
+// immichAuthHeader Keeps only the headers immich uses to authenticate a request
+func immichAuthHeader(header http.Header) http.Header {
+	authHeader := http.Header{}
+	for _, key := range []string{"Authorization", "Cookie", "X-Api-Key", "X-Immich-User-Token", "X-Immich-Session-Token", "X-Immich-Share-Key", "X-Immich-Share-Slug"} {
+		if values, ok := header[key]; ok {
+			authHeader[key] = values
+		}
+	}
+	return authHeader
+}
+
+// immichJSON Sends a request to immich and decodes the JSON response into v
+func immichJSON(method, apiPath string, header http.Header, body io.Reader, v any) error {
+	resp, err := immichRequest(method, apiPath, header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &immichError{method, apiPath, resp.StatusCode, string(msg)}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// getImmichUser Returns the user making the request
+func getImmichUser(header http.Header) (user map[string]any, err error) {
+	err = immichJSON("GET", "/api/users/me", header, nil, &user)
+	return
+}
+
+// apiKeyHeader Authenticates commands with an immich API key
+func apiKeyHeader(apiKey string) http.Header {
+	return http.Header{"X-Api-Key": {apiKey}}
+}
+
+// searchAssetsByChecksum Returns the assets of the user with the stored file checksum
+func searchAssetsByChecksum(header http.Header, checksum string) ([]Asset, error) {
+	body, err := json.Marshal(map[string]any{"checksum": checksum})
+	if err != nil {
+		return nil, err
+	}
+	var result struct {
+		Assets struct {
+			Items []Asset `json:"items"`
+		} `json:"assets"`
+	}
+	err = immichJSON("POST", "/api/search/metadata", header, bytes.NewReader(body), &result)
+	return result.Assets.Items, err
+}
+
+// immichUpload Sends a file to immich as multipart form data like the apps do, the file is streamed
+func immichUpload(method, apiPath string, header http.Header, fields map[string]string, filename string, file io.Reader, v any) error {
+	pipeReader, pipeWriter := io.Pipe()
+	multipartWriter := multipart.NewWriter(pipeWriter)
+	go func() {
+		for key, value := range fields {
+			if err := multipartWriter.WriteField(key, value); err != nil {
+				_ = pipeWriter.CloseWithError(err)
+				return
+			}
+		}
+		part, err := multipartWriter.CreateFormFile(filterFormKey, filename)
+		if err == nil {
+			_, err = io.Copy(part, file)
+		}
+		if err == nil {
+			err = multipartWriter.Close()
+		}
+		_ = pipeWriter.CloseWithError(err)
+	}()
+	defer pipeReader.Close()
+	req, err := http.NewRequest(method, upstreamURL+apiPath, pipeReader)
+	if err != nil {
+		return err
+	}
+	req.Header = immichAuthHeader(header)
+	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	req.Header.Set("Accept", "application/json")
+	resp, err := getHTTPclient().Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return &immichError{method, apiPath, resp.StatusCode, string(msg)}
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// immichError Unexpected HTTP status returned by immich
+type immichError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Message    string
+}
+
+func (e *immichError) Error() string {
+	return fmt.Sprintf("%s %s: HTTP %d: %s", e.Method, e.Path, e.StatusCode, e.Message)
+}
+
+// replaceAsset Replaces the file of an asset. The asset keeps its id when immich supports replacing files,
+// otherwise the file is uploaded as a new asset, albums, favorite, shared links and stack are copied, and the old asset is trashed.
+// Returns the id of the asset having the file
+func replaceAsset(header http.Header, asset Asset, file io.ReadSeeker, filename string) (string, error) {
+	assetID := fmt.Sprint(asset["id"])
+	fields := map[string]string{"filename": filename}
+	for _, key := range []string{"deviceAssetId", "deviceId", "fileCreatedAt", "fileModifiedAt", "duration"} {
+		if value, ok := asset[key].(string); ok {
+			fields[key] = value
+		}
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	var result map[string]any
+	err := immichUpload("PUT", "/api/assets/"+assetID+"/original", header, fields, filename, file, &result)
+	var immichErr *immichError
+	if !errors.As(err, &immichErr) || immichErr.StatusCode != http.StatusNotFound && immichErr.StatusCode != http.StatusMethodNotAllowed {
+		return assetID, err
+	}
+
+	// This immich version can't replace files
+	if _, err = file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	if err = immichUpload("POST", "/api/assets", header, fields, filename, file, &result); err != nil {
+		return "", err
+	}
+	newID := fmt.Sprint(result["id"])
+	if newID == assetID {
+		return "", errors.New("immich returned the same asset")
+	}
+	copyBody, _ := json.Marshal(map[string]any{"sourceId": assetID, "targetId": newID, "albums": true, "favorite": true, "sharedLinks": true, "sidecar": true, "stack": true})
+	if err = immichJSON("PUT", "/api/assets/copy", header, bytes.NewReader(copyBody), nil); err != nil {
+		return newID, fmt.Errorf("uploaded as %s, unable to copy albums and favorite: %w", newID, err)
+	}
+	deleteBody, _ := json.Marshal(map[string]any{"ids": []string{assetID}, "force": false})
+	if err = immichJSON("DELETE", "/api/assets", header, bytes.NewReader(deleteBody), nil); err != nil {
+		return newID, fmt.Errorf("uploaded as %s, unable to trash the old asset: %w", newID, err)
+	}
+	return newID, nil
+}
+
+// searchAssetsPage Returns a page of the user assets matching the search filters with their EXIF info, oldest first. next is 0 on the last page
+func searchAssetsPage(header http.Header, filters map[string]any, page, size int) (assets []Asset, next int, err error) {
+	search := map[string]any{"page": page, "size": size, "withExif": true, "order": "asc"}
+	for key, value := range filters {
+		search[key] = value
+	}
+	body, err := json.Marshal(search)
+	if err != nil {
+		return nil, 0, err
+	}
+	var result struct {
+		Assets struct {
+			Items    []Asset `json:"items"`
+			NextPage *string `json:"nextPage"`
+		} `json:"assets"`
+	}
+	if err = immichJSON("POST", "/api/search/metadata", header, bytes.NewReader(body), &result); err != nil {
+		return nil, 0, err
+	}
+	if result.Assets.NextPage != nil {
+		next, _ = strconv.Atoi(*result.Assets.NextPage)
+	}
+	return result.Assets.Items, next, nil
+}
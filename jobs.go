@@ -1,88 +1,293 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha1"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"mime"
 	"mime/multipart"
 	"net/http"
+	"os"
+	"path/filepath"
 )
 
 var jobID int
 
+// errPassthrough is returned by newJob when no task matches the upload, the untouched request body must then be proxied to immich
+var errPassthrough = errors.New("passthrough")
+
+// errResponseSent is wrapped by uploadUpstream errors happening after the immich response was forwarded, the client must not get another response
+var errResponseSent = errors.New("response already sent to the client")
+
 func newJob(r *http.Request, w http.ResponseWriter, logger *customLogger) error {
 	jobID++
 	jobLogger := newCustomLogger(logger, fmt.Sprintf("job %d: ", jobID))
 
-	formFile, formFileHeader, err := r.FormFile(filterFormKey)
+	form, err := newUploadForm(r)
+	if form == nil {
+		// Nothing was read yet: immich answers the malformed request
+		jobLogger.Printf("passthrough: %v", err)
+		return errPassthrough
+	}
+
+	// Decide from the file part headers only, passthrough the request to immich if there's no task
+	var task *Task
+	if err == nil {
+		task, err = findTask(form.Filename, r.ContentLength)
+	}
+	if task == nil {
+		r.Body = form.passthroughBody()
+		jobLogger.Printf("passthrough: \"%s\" (%s): %v", form.Filename, humanReadableSize(r.ContentLength), err)
+		return errPassthrough
+	}
+	form.stopRecording()
+
+	// The original is written to the queue directory when uploads must survive a restart
+	originalDir := ""
+	if queueUploads {
+		if err = os.MkdirAll(queueDir, 0755); err != nil {
+			return err
+		}
+		originalDir = queueDir
+	}
+	taskProcessor, err := NewTaskProcessorIn(originalDir, task, form.File, form.Filename)
 	if err != nil {
-		return fmt.Errorf("unable to read file in key %s from uploaded form data: %w", filterFormKey, err)
+		return err
+	}
+	defer taskProcessor.Close()
+	taskProcessor.SetLogger(jobLogger)
+	if err = form.readRemainingValues(); err != nil {
+		return err
+	}
+	taskProcessor.SetForm(form.Values, r.Header)
+	if task.Async && taskProcessor.OriginalSize >= task.MinFilesizeBytes {
+		return queueJob(w, r, form, taskProcessor, jobLogger)
+	}
+	// Result of the checksums record of the processed file, nil if none was added
+	var recorded <-chan error
+	if queueUploads {
+		job, err := saveUploadJob(taskProcessor, form.Values, r.Header)
+		if !jobLogger.Error(err, "queue") {
+			// The original is removed by the task processor. The checksums record is written first:
+			// a replay of a job interrupted before it's gone finds the processed file and doesn't upload the original again
+			defer func() {
+				if recorded != nil {
+					if err := <-recorded; err != nil {
+						jobLogger.Printf("checksums record not written, upload kept in the queue: %s", job.ID)
+						taskProcessor.KeepOriginal()
+						return
+					}
+				}
+				_ = os.Remove(filepath.Join(queueDir, job.ID+".json"))
+			}()
+		}
 	}
-	defer r.MultipartForm.RemoveAll()
-	defer formFile.Close()
 
-	jobLogger.Printf("download original: \"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
+	jobLogger.Printf("download original: \"%s\" (%s)", taskProcessor.OriginalFilename, humanReadableSize(taskProcessor.OriginalSize))
 
-	var originalHash string
-	var newHash string
-	uploadFile := formFile
-	uploadFilename := formFileHeader.Filename
+	var uploadFile io.Reader = taskProcessor.OriginalFile
+	uploadFilename := taskProcessor.OriginalFilename
 	uploadOriginal := true
+	var archived string
 
-	taskProcessor, err := NewTaskProcessorFromMultipart(formFile, formFileHeader)
-	if err == nil && taskProcessor != nil {
-		defer taskProcessor.Close()
-		taskProcessor.SetLogger(jobLogger)
-		// Delete multipart file before running command. Saves RAM (tmpfs)
-		_ = formFile.Close()
-		_ = r.MultipartForm.RemoveAll()
-		if err = taskProcessor.Run(); err != nil {
-			return fmt.Errorf("failed to process file in job %d: %v", jobID, err.Error())
-		}
-		if taskProcessor.OriginalSize <= taskProcessor.ProcessedSize {
-			uploadFile = taskProcessor.OriginalFile
-			_ = taskProcessor.CleanWorkDir() // Save RAM before upload (tmpfs)
-		} else {
-			uploadFile = taskProcessor.ProcessedFile
-			uploadFilename = taskProcessor.ProcessedFilename
-			uploadOriginal = false
-			if originalHash, err = SHA1(taskProcessor.OriginalFile); err != nil {
-				return fmt.Errorf("sha1: %w", err)
+	if taskProcessor.OriginalSize >= task.MinFilesizeBytes {
+		switch task.IO {
+		case TaskIOStream:
+			if err = taskProcessor.RunStream(); errors.Is(err, errStreamFailed) {
+				// The command failed before the upload started
+				jobLogger.Printf("%v, uploading original", err)
+				break
+			} else if err != nil {
+				return fmt.Errorf("failed to process file in job %d: %v", jobID, err.Error())
+			}
+			if taskProcessor.ProcessedStream == nil {
+				break
+			}
+			// The original must be safe before it's replaced
+			if archived, err = archiveOriginal(taskProcessor); err != nil {
+				jobLogger.Printf("%v, uploading original", err)
+				break
+			}
+			// The command output is piped straight into the upload
+			uploadHash, assetID, err := uploadUpstream(w, r, form.Values, taskProcessor.ProcessedStream, taskProcessor.ProcessedFilename)
+			if err == nil {
+				recorded = addChecksums(uploadHash, taskProcessor.OriginalHash, archived, assetID, taskProcessor.Task.Name)
+				jobLogger.Printf("uploaded: \"%s\" (%s) <- (%s) \"%s\"", taskProcessor.ProcessedFilename, humanReadableSize(taskProcessor.ProcessedSize), humanReadableSize(taskProcessor.OriginalSize), taskProcessor.OriginalFilename)
+				return nil
+			}
+			if !errors.Is(err, errStreamTooLarge) && !errors.Is(err, errStreamFailed) {
+				jobLogger.Printf("upload upstream error: %s", err.Error())
+				if !errors.Is(err, errResponseSent) {
+					http.Error(w, "failed to process file, view logs for more info", http.StatusInternalServerError)
+				}
+				return nil
+			}
+			// Nothing was sent to the client yet, fallback to the original
+			jobLogger.Printf("stream upload aborted: %v", err)
+			discardArchivedOriginal(archived, jobLogger)
+		default:
+			if err = taskProcessor.Run(); err != nil {
+				return fmt.Errorf("failed to process file in job %d: %v", jobID, err.Error())
+			}
+			if taskProcessor.OriginalSize <= taskProcessor.ProcessedSize {
+				_ = taskProcessor.CleanWorkDir() // Save RAM before upload (tmpfs)
+			} else if err = taskProcessor.VerifyReconstruction(); err != nil {
+				jobLogger.Printf("reconstruction check failed, uploading original: %v", err)
+				_ = taskProcessor.CleanWorkDir()
+			} else if archived, err = archiveOriginal(taskProcessor); err != nil {
+				jobLogger.Printf("%v, uploading original", err)
+				_ = taskProcessor.CleanWorkDir()
+			} else {
+				uploadFile = taskProcessor.ProcessedFile
+				uploadFilename = taskProcessor.ProcessedFilename
+				uploadOriginal = false
+				if !queueUploads {
+					_ = taskProcessor.CleanOriginalFile() // Save RAM before upload (tmpfs), a queued upload is replayed from it
+				}
 			}
-			_ = taskProcessor.CleanOriginalFile() // Save RAM before upload (tmpfs)
 		}
 	}
 	// Upload the original file or processed one if a task was found
-	err = uploadUpstream(w, r, uploadFile, uploadFilename)
+	// The uploaded file is hashed while it's streamed to immich
+	uploadHash, assetID, err := uploadUpstream(w, r, form.Values, uploadFile, uploadFilename)
 	if err != nil {
 		jobLogger.Printf("upload upstream error: %s", err.Error())
-		http.Error(w, "failed to process file, view logs for more info", http.StatusInternalServerError)
+		if !errors.Is(err, errResponseSent) {
+			http.Error(w, "failed to process file, view logs for more info", http.StatusInternalServerError)
+		}
+		return nil
 	}
 	if uploadOriginal {
-		jobLogger.Printf("uploaded original: \"%s\" (%s)", formFileHeader.Filename, humanReadableSize(formFileHeader.Size))
+		jobLogger.Printf("uploaded original: \"%s\" (%s)", taskProcessor.OriginalFilename, humanReadableSize(taskProcessor.OriginalSize))
 	} else {
-		if newHash, err = SHA1(taskProcessor.ProcessedFile); err != nil {
-			return fmt.Errorf("new sha1: %w", err)
-		}
-		addChecksums(newHash, originalHash)
+		recorded = addChecksums(uploadHash, taskProcessor.OriginalHash, archived, assetID, taskProcessor.Task.Name)
 		jobLogger.Printf("uploaded: \"%s\" (%s) <- (%s) \"%s\"", taskProcessor.ProcessedFilename, humanReadableSize(taskProcessor.ProcessedSize), humanReadableSize(taskProcessor.OriginalSize), taskProcessor.OriginalFilename)
+		if downloadCachePrewarm {
+			prewarmDownloadCache(taskProcessor.ProcessedFile.Name(), uploadHash, jobLogger)
+		}
+	}
+
+	return nil
+}
+
+// uploadForm Reads the multipart upload as a stream: form values are parsed until the file part is reached, the file part is never buffered
+type uploadForm struct {
+	Values   map[string][]string
+	File     *multipart.Part
+	Filename string
+
+	body     io.ReadCloser
+	recorder *recordingReader
+	reader   *multipart.Reader
+}
+
+// newUploadForm Reads the form until the file part. On error the returned form can still be used to passthrough the request
+func newUploadForm(r *http.Request) (*uploadForm, error) {
+	_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse content type: %w", err)
+	}
+	boundary, ok := params["boundary"]
+	if !ok {
+		return nil, errors.New("missing multipart boundary")
+	}
+	form := &uploadForm{
+		Values:   make(map[string][]string),
+		body:     r.Body,
+		recorder: &recordingReader{reader: r.Body, buf: &bytes.Buffer{}},
+	}
+	form.reader = multipart.NewReader(form.recorder, boundary)
+	for {
+		part, err := form.reader.NextPart()
+		if err != nil {
+			return form, fmt.Errorf("unable to read file in key %s from uploaded form data: %w", filterFormKey, err)
+		}
+		if part.FormName() == filterFormKey {
+			form.File = part
+			form.Filename = part.FileName()
+			return form, nil
+		}
+		if err = form.readValue(part); err != nil {
+			return form, err
+		}
 	}
+}
 
+func (form *uploadForm) readValue(part *multipart.Part) error {
+	defer part.Close()
+	value, err := io.ReadAll(io.LimitReader(part, maxFormValueSize+1))
+	if err != nil {
+		return fmt.Errorf("unable to read form value %s: %w", part.FormName(), err)
+	}
+	if len(value) > maxFormValueSize {
+		return fmt.Errorf("form value %s is too big", part.FormName())
+	}
+	form.Values[part.FormName()] = append(form.Values[part.FormName()], string(value))
 	return nil
 }
 
-func uploadUpstream(w http.ResponseWriter, r *http.Request, file io.ReadSeeker, name string) (err error) {
+// readRemainingValues Reads the form values sent after the file part, must be called after the file part has been consumed
+func (form *uploadForm) readRemainingValues() error {
+	for {
+		part, err := form.reader.NextPart()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("unable to read uploaded form data: %w", err)
+		}
+		if err = form.readValue(part); err != nil {
+			return err
+		}
+	}
+}
+
+// passthroughBody Returns the untouched request body: the bytes already consumed by the multipart reader followed by the unread ones
+func (form *uploadForm) passthroughBody() io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(form.recorder.buf.Bytes()), form.body), form.body}
+}
+
+func (form *uploadForm) stopRecording() {
+	form.recorder.buf = nil
+}
+
+const maxFormValueSize = 1 << 20
+
+// recordingReader Keeps a copy of everything read until buf is set to nil
+type recordingReader struct {
+	reader io.Reader
+	buf    *bytes.Buffer
+}
+
+func (rr *recordingReader) Read(p []byte) (n int, err error) {
+	n, err = rr.reader.Read(p)
+	if rr.buf != nil && n > 0 {
+		rr.buf.Write(p[:n])
+	}
+	return
+}
+
+// uploadUpstream Uploads the file to immich and forwards its response to the client. Returns the checksum of the uploaded file and the id of its asset
+func uploadUpstream(w http.ResponseWriter, r *http.Request, values map[string][]string, file io.Reader, name string) (checksum, assetID string, err error) {
 	pipeReader, pipeWriter := io.Pipe()
 	multipartWriter := multipart.NewWriter(pipeWriter)
 	errChan := make(chan error, 1)
-	defer close(errChan)
+	hasher := sha1.New()
 	// Prepare chunked request, this saves A LOT of RAM compared to building the whole buffer in RAM.
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 	go func() {
+		var err error
 		defer pipeWriter.Close()
 		defer multipartWriter.Close()
-		for key, values := range r.MultipartForm.Value {
+		for key, values := range values {
 			for _, value := range values {
 				if key == "filename" {
 					value = name
@@ -101,13 +306,15 @@ func uploadUpstream(w http.ResponseWriter, r *http.Request, file io.ReadSeeker,
 			errChan <- fmt.Errorf("unable to create form data: %w", err)
 			return
 		}
-		_, err = file.Seek(0, io.SeekStart)
-		if err != nil {
-			cancel()
-			errChan <- fmt.Errorf("unable to seek beginning of file: %w", err)
-			return
+		if seeker, ok := file.(io.Seeker); ok {
+			_, err = seeker.Seek(0, io.SeekStart)
+			if err != nil {
+				cancel()
+				errChan <- fmt.Errorf("unable to seek beginning of file: %w", err)
+				return
+			}
 		}
-		_, err = io.Copy(part, file)
+		_, err = io.Copy(part, io.TeeReader(file, hasher))
 		if err != nil {
 			cancel()
 			errChan <- fmt.Errorf("unable to write file in form field: %w", err)
@@ -123,30 +330,42 @@ func uploadUpstream(w http.ResponseWriter, r *http.Request, file io.ReadSeeker,
 	}()
 	req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL+r.URL.String(), pipeReader)
 	if err != nil {
-		return fmt.Errorf("unable to create POST request: %w", err)
+		return "", "", fmt.Errorf("unable to create POST request: %w", err)
 	}
 	req.Header = r.Header
 	req.Header.Set("Content-Type", multipartWriter.FormDataContentType())
+	// The response is read to get the asset id, it's small
+	req.Header.Del("Accept-Encoding")
 	// Send the request to the upstream server
 	resp, err := getHTTPclient().Do(req)
-	defer resp.Body.Close()
 	if err != nil {
-		select {
-		case chErr := <-errChan:
-			if err != nil {
-				return fmt.Errorf("error writing data to pipe: %v: %v", err, chErr)
-			}
-		default:
+		// Wait for the writer to know if the request failed because of the file being uploaded
+		_ = pipeReader.Close()
+		if chErr := <-errChan; chErr != nil {
+			return "", "", fmt.Errorf("error writing data to pipe: %v: %w", err, chErr)
 		}
-		return fmt.Errorf("unable to POST: %w", err)
+		return "", "", fmt.Errorf("unable to POST: %w", err)
 	}
+	defer resp.Body.Close()
+	// Unblock the writer in case immich replied before reading the whole body
+	defer pipeReader.Close()
 	// Send immich response back to client
 	setHeaders(w.Header(), resp.Header)
 	w.WriteHeader(resp.StatusCode)
-	_, err = io.Copy(w, resp.Body)
+	var response bytes.Buffer
+	_, err = io.Copy(w, io.TeeReader(resp.Body, &response))
 	if err != nil {
-		return fmt.Errorf("unable to forward response to client: %v", err)
+		return "", "", fmt.Errorf("unable to forward response to client: %v: %w", err, errResponseSent)
+	}
+	_ = pipeReader.Close()
+	var asset struct {
+		ID string `json:"id"`
+	}
+	_ = json.Unmarshal(response.Bytes(), &asset)
+	// The stream errors aren't wrapped: the client already got the immich response, the original can't be uploaded instead
+	if err = <-errChan; err != nil {
+		return "", "", fmt.Errorf("%v: %w", err, errResponseSent)
 	}
 
-	return nil
+	return encodeChecksum(hasher), asset.ID, nil
 }
@@ -1,19 +1,16 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
 	"os"
-	"os/exec"
 	"strings"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -34,8 +31,29 @@ var upstreamURL string
 var listenAddr string
 var configFile string
 var checksumsFile string
+var checksumsGCGrace time.Duration
+var checksumsReloadInterval time.Duration
 var downloadJpgFromJxl bool
 var downloadJpgFromAvif bool
+var downloadCacheDir string
+var downloadCacheSizeMB int64
+var downloadCachePrewarm bool
+var processingCacheDir string
+var processingCacheSizeMB int64
+var queueDir string
+var queueUploads bool
+var downloadVideoCodec string
+var downloadVideoConcurrency int
+var vaultLocation string
+var vaultS3Endpoint string
+var vaultS3Region string
+var vaultS3AccessKey string
+var vaultS3SecretKey string
+var vaultDownloadUsers string
+var apiKeys string
+
+var downloadCache *fileCache
+var processingCache *fileCache
 
 var config *Config
 
@@ -45,23 +63,78 @@ func init() {
 	viper.BindEnv("upstream")
 	viper.BindEnv("listen")
 	viper.BindEnv("tasks_file")
+	viper.BindEnv("checksums_gc_grace")
+	viper.BindEnv("checksums_reload_interval")
 	viper.BindEnv("download_jpg_from_jxl")
 	viper.BindEnv("download_jpg_from_avif")
+	viper.BindEnv("download_cache_dir")
+	viper.BindEnv("download_cache_size_mb")
+	viper.BindEnv("download_cache_prewarm")
+	viper.BindEnv("processing_cache_dir")
+	viper.BindEnv("processing_cache_size_mb")
+	viper.BindEnv("queue_dir")
+	viper.BindEnv("queue_uploads")
+	viper.BindEnv("download_video_codec")
+	viper.BindEnv("download_video_concurrency")
+	viper.BindEnv("vault")
+	viper.BindEnv("vault_s3_endpoint")
+	viper.BindEnv("vault_s3_region")
+	viper.BindEnv("vault_s3_access_key")
+	viper.BindEnv("vault_s3_secret_key")
+	viper.BindEnv("vault_download_users")
+	viper.BindEnv("api_key")
 
 	viper.SetDefault("upstream", "")
 	viper.SetDefault("listen", ":2284")
 	viper.SetDefault("tasks_file", "config/lossy_avif.yaml")
 	viper.SetDefault("checksums_file", "checksums.csv")
+	viper.SetDefault("checksums_gc_grace", 24*time.Hour)
+	viper.SetDefault("checksums_reload_interval", 2*time.Second)
 	viper.SetDefault("download_jpg_from_jxl", false)
 	viper.SetDefault("download_jpg_from_avif", false)
+	viper.SetDefault("download_cache_dir", "")
+	viper.SetDefault("download_cache_size_mb", 1024)
+	viper.SetDefault("download_cache_prewarm", false)
+	viper.SetDefault("processing_cache_dir", "")
+	viper.SetDefault("processing_cache_size_mb", 1024)
+	viper.SetDefault("queue_dir", "queue")
+	viper.SetDefault("queue_uploads", false)
+	viper.SetDefault("download_video_codec", "")
+	viper.SetDefault("download_video_concurrency", 1)
+	viper.SetDefault("vault", "")
+	viper.SetDefault("vault_s3_endpoint", "")
+	viper.SetDefault("vault_s3_region", "us-east-1")
+	viper.SetDefault("vault_s3_access_key", "")
+	viper.SetDefault("vault_s3_secret_key", "")
+	viper.SetDefault("vault_download_users", "")
+	viper.SetDefault("api_key", "")
 
 	flag.BoolVar(&showVersion, "version", false, "Show the current version")
 	flag.StringVar(&upstreamURL, "upstream", viper.GetString("upstream"), "Upstream URL. Example: http://immich-server:2283")
 	flag.StringVar(&listenAddr, "listen", viper.GetString("listen"), "Listening address")
 	flag.StringVar(&configFile, "tasks_file", viper.GetString("tasks_file"), "Path to the configuration file")
 	flag.StringVar(&checksumsFile, "checksums_file", viper.GetString("checksums_file"), "Path to the checksums file")
+	flag.DurationVar(&checksumsGCGrace, "checksums_gc_grace", viper.GetDuration("checksums_gc_grace"), "Time after an asset is permanently deleted before its checksums records are removed. Disabled if 0")
+	flag.DurationVar(&checksumsReloadInterval, "checksums_reload_interval", viper.GetDuration("checksums_reload_interval"), "How often the checksums file is checked for records added by other instances sharing it. Disabled if 0")
 	flag.BoolVar(&downloadJpgFromJxl, "download_jpg_from_jxl", viper.GetBool("download_jpg_from_jxl"), "Converts JXL images to JPG on download for wider compatibility")
 	flag.BoolVar(&downloadJpgFromAvif, "download_jpg_from_avif", viper.GetBool("download_jpg_from_avif"), "Converts AVIF images to JPG on download for wider compatibility")
+	flag.StringVar(&downloadCacheDir, "download_cache_dir", viper.GetString("download_cache_dir"), "Directory where converted downloads are cached. Disabled if empty")
+	flag.Int64Var(&downloadCacheSizeMB, "download_cache_size_mb", viper.GetInt64("download_cache_size_mb"), "Maximum size of the converted downloads cache in MB")
+	flag.BoolVar(&downloadCachePrewarm, "download_cache_prewarm", viper.GetBool("download_cache_prewarm"), "Converts uploaded files right away so their first download is served from the cache")
+	flag.StringVar(&processingCacheDir, "processing_cache_dir", viper.GetString("processing_cache_dir"), "Directory where task outputs are cached, a repeated upload of the same file isn't processed again. Disabled if empty")
+	flag.Int64Var(&processingCacheSizeMB, "processing_cache_size_mb", viper.GetInt64("processing_cache_size_mb"), "Maximum size of the task outputs cache in MB")
+	flag.StringVar(&queueDir, "queue_dir", viper.GetString("queue_dir"), "Directory where the jobs of async tasks are kept until they're processed")
+	flag.BoolVar(&queueUploads, "queue_uploads", viper.GetBool("queue_uploads"), "Keeps the uploads being processed in the queue directory, uploads interrupted by a restart are replayed to immich")
+	flag.StringVar(&downloadVideoCodec, "download_video_codec", viper.GetString("download_video_codec"), "Transcodes HEVC videos to h264 or av1 on download for browsers that can't play them. Disabled if empty")
+	flag.IntVar(&downloadVideoConcurrency, "download_video_concurrency", viper.GetInt("download_video_concurrency"), "Maximum number of concurrent video transcodes")
+	flag.StringVar(&vaultLocation, "vault", viper.GetString("vault"), "Directory or s3://bucket/prefix where originals are archived before being replaced. Disabled if empty")
+	flag.StringVar(&vaultS3Endpoint, "vault_s3_endpoint", viper.GetString("vault_s3_endpoint"), "S3 compatible endpoint of the vault. Example: http://minio:9000")
+	flag.StringVar(&vaultS3Region, "vault_s3_region", viper.GetString("vault_s3_region"), "S3 region of the vault")
+	flag.StringVar(&vaultS3AccessKey, "vault_s3_access_key", viper.GetString("vault_s3_access_key"), "S3 access key of the vault")
+	flag.StringVar(&vaultS3SecretKey, "vault_s3_secret_key", viper.GetString("vault_s3_secret_key"), "S3 secret key of the vault")
+	flag.StringVar(&vaultDownloadUsers, "vault_download_users", viper.GetString("vault_download_users"), "Comma separated emails or ids of the immich users whose original downloads are served from the vault")
+	flag.StringVar(&apiKeys, "api_key", viper.GetString("api_key"), "Comma separated immich API keys used by commands, one for each user to process")
+	flag.Usage = printUsage
 	flag.Parse()
 
 	if showVersion {
@@ -69,9 +142,13 @@ func init() {
 		os.Exit(0)
 	}
 
-	validateInput()
-
 	proxyUrl, _ = url.Parse("http://localhost:8080")
+	if flag.NArg() > 0 {
+		// Commands validate their own input
+		return
+	}
+
+	validateInput()
 	initChecksums()
 }
 
@@ -83,6 +160,9 @@ var DevMITMproxy = version == "dev"
 
 func main() {
 	baseLogger = log.New(os.Stdout, "", log.Ldate|log.Ltime)
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Args()))
+	}
 	log.Printf("Starting %s on %s...", printVersion(), listenAddr)
 	tmpDir := os.Getenv("TMPDIR")
 	if tmpDir != "" {
@@ -96,6 +176,44 @@ func main() {
 	} else {
 		log.Printf("no tmp directory set, uploaded files will be saved on disk multiple times, this can shorten your disk lifespan !")
 	}
+	if downloadCacheDir != "" {
+		var err error
+		if downloadCache, err = newFileCache(downloadCacheDir, downloadCacheSizeMB<<20); err != nil {
+			log.Fatalf("download cache: %v", err)
+		}
+		log.Printf("download cache: %s (%s / %s)", downloadCacheDir, humanReadableSize(downloadCache.size), humanReadableSize(downloadCache.maxSize))
+	}
+	if processingCacheDir != "" {
+		var err error
+		if processingCache, err = newFileCache(processingCacheDir, processingCacheSizeMB<<20); err != nil {
+			log.Fatalf("processing cache: %v", err)
+		}
+		log.Printf("processing cache: %s (%s / %s)", processingCacheDir, humanReadableSize(processingCache.size), humanReadableSize(processingCache.maxSize))
+	}
+	if vaultLocation != "" {
+		var err error
+		if vault, err = newVault(vaultLocation); err != nil {
+			log.Fatalf("vault: %v", err)
+		}
+		log.Printf("vault: %s", vaultLocation)
+		go pruneVault()
+	}
+	if checksumsReloadInterval > 0 {
+		go watchChecksums()
+	}
+	if checksumsGCGrace > 0 {
+		if err := loadDeletedAssets(); err != nil {
+			log.Printf("checksums gc: %v", err)
+		}
+		go collectChecksums()
+	}
+	if err := loadQueue(); err != nil {
+		log.Printf("queue: %v", err)
+	}
+	if hasAsyncTasks() || queueUploads || len(queue) > 0 {
+		log.Printf("queue: %s", queueDir)
+		go runQueue()
+	}
 	// Proxy
 	proxy = httputil.NewSingleHostReverseProxy(remote)
 	if DevMITMproxy {
@@ -121,19 +239,40 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 			logger.Printf("request URL: %s", r.URL.String())
 		}
 	}()
-	if downloadJpgFromJxl || downloadJpgFromAvif {
+	if vault != nil {
+		if ok, assetUUID := isOriginalDownloadPath(r); ok && vaultRequested(r) {
+			if err = downloadFromVault(w, r, logger, assetUUID[1]); err == nil {
+				return
+			}
+		}
+	}
+	if downloadVideoCodec != "" {
+		if ok, matches := isVideoDownloadPath(r); ok {
+			if err = downloadAndTranscodeVideo(w, r, logger, matches[1], matches[2]); err == nil {
+				return
+			}
+		}
+	}
+	if len(config.DownloadTasks) > 0 {
 		if ok, assetUUID := isOriginalDownloadPath(r); ok {
 			if err = downloadAndConvertImage(w, r, logger, assetUUID[1]); err == nil {
 				return
 			}
 		}
+		if isDownloadArchive(r) {
+			if err = downloadAndConvertArchive(w, r, logger); err == nil {
+				return
+			}
+		}
 	}
 	switch {
 	case err != nil:
 		break
 	case isAssetsUpload(r):
-		err = newJob(r, w, logger)
 		logger.SetErrPrefix("upload")
+		if err = newJob(r, w, logger); errors.Is(err, errPassthrough) {
+			break
+		}
 		logger.Error(err, "")
 		return
 	default:
@@ -144,108 +283,18 @@ func handleRequest(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 	}
-	r.Host = remote.Host
-	proxy.ServeHTTP(w, r)
-}
-
-const (
-	NONE = iota
-	JXL
-	AVIF
-)
-
-func downloadAndConvertImage(w http.ResponseWriter, r *http.Request, logger *customLogger, assetUUID string) (err error) {
-	logger.SetErrPrefix("download and convert")
-	var req *http.Request
-	var resp *http.Response
-	if req, err = http.NewRequest(r.Method, upstreamURL+"/api/assets/"+assetUUID, nil); logger.Error(err, "new GET") {
-		return
-	}
-	req.Header = r.Header
-	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
-		return
-	}
-	defer resp.Body.Close()
-	bodyReader, _ := getBodyWriterReaderHTTP(nil, resp)
-	defer bodyReader.Close()
-	var jsonBuf []byte
-	if jsonBuf, err = io.ReadAll(bodyReader); logger.Error(err, "resp read") {
-		return
-	}
-	if resp.StatusCode != http.StatusOK {
-		return errors.New("not HTTP ok")
-	}
-	var asset Asset
-	if err = json.Unmarshal(jsonBuf, &asset); logger.Error(err, "json unmarshal") {
-		return
-	}
-	mimeType := NONE
-	if n, ok := asset["originalMimeType"]; ok {
-		if originalMimeType, ok := n.(string); ok {
-			if downloadJpgFromJxl && originalMimeType == "image/jxl" {
-				mimeType = JXL
-			} else if downloadJpgFromAvif && originalMimeType == "image/avif" {
-				mimeType = AVIF
+	if checksumsGCGrace > 0 {
+		if deleting := deletingAssets(r, logger); len(deleting) > 0 {
+			// The assets are gone only if immich accepted the request
+			recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+			r.Host = remote.Host
+			proxy.ServeHTTP(recorder, r)
+			if recorder.status >= 200 && recorder.status <= 299 {
+				observeDeletedAssets(deleting, logger)
 			}
-		}
-	}
-	if mimeType == NONE {
-		return errors.New("no conversion needed")
-	}
-	// Download file and convert
-	logger.Printf("converting to jpg: %s", r.URL)
-	var blob *os.File
-	if req, err = http.NewRequest("GET", upstreamURL+r.URL.String(), nil); logger.Error(err, "new GET") {
-		return
-	}
-	req.Header = r.Header
-	if resp, err = getHTTPclient().Do(req); logger.Error(err, "getHTTPclient.Do") {
-		return
-	}
-	if blob, err = os.CreateTemp("", "blob-*"); logger.Error(err, "blob create") {
-		return
-	}
-	cleanupBlob := func() { blob.Close(); _ = os.Remove(blob.Name()) }
-	defer cleanupBlob()
-	if _, err = io.Copy(blob, resp.Body); logger.Error(err, "blob copy") {
-		return
-	}
-	resp.Body.Close()
-	if _, err = blob.Seek(0, io.SeekStart); logger.Error(err, "blob seek") {
-		return
-	}
-	signature := make([]byte, 12)
-	if _, err = blob.Read(signature); logger.Error(err, "blob read") {
-		return
-	}
-	var output []byte
-	var open *os.File
-	switch mimeType {
-	case JXL:
-		if !bytes.Equal(signature, []byte{0x00, 0x00, 0x00, 0x0C, 0x4A, 0x58, 0x4C, 0x20, 0x0D, 0x0A, 0x87, 0x0A}) {
-			return errors.New("bad jxl signature")
-		}
-		if output, err = exec.Command("djxl", blob.Name(), blob.Name()+".jpg").CombinedOutput(); logger.Error(err, "djxl") {
-			return
-		}
-	case AVIF:
-		if !bytes.Equal(signature[4:], []byte("ftypavif")) {
-			return errors.New("bad avif signature")
-		}
-		if output, err = exec.Command("avifdec", "-q", "95", blob.Name(), blob.Name()+".jpg").CombinedOutput(); logger.Error(err, "avifdec") {
 			return
 		}
-	default:
-		return errors.New("should never happen")
-	}
-	logger.Printf("conversion complete: %s", strings.ReplaceAll(string(output), "\n", " - "))
-	cleanupBlob()
-	if open, err = os.Open(blob.Name() + ".jpg"); logger.Error(err, "open jpg") {
-		return
 	}
-	defer func() { open.Close(); _ = os.Remove(open.Name()) }()
-	if _, err = io.Copy(w, open); logger.Error(err, "write resp") {
-		return
-	}
-	return nil
+	r.Host = remote.Host
+	proxy.ServeHTTP(w, r)
 }
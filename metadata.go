@@ -0,0 +1,77 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"reflect"
+	"strings"
+	"sync"
+)
+
+const (
+	MetadataExiftool = "exiftool"
+	MetadataNone     = "none"
+)
+
+// keyMetadataTags Tags that must survive a download conversion
+var keyMetadataTags = []string{"DateTimeOriginal", "CreateDate", "OffsetTimeOriginal", "GPSLatitude", "GPSLongitude", "Make", "Model", "ProfileDescription"}
+
+var exiftoolPath = sync.OnceValues(func() (string, error) {
+	return exec.LookPath("exiftool")
+})
+
+// copyMetadata Copies EXIF, XMP, IPTC and the ICC color profile from src to dst, and sets the dst file time to the capture date (the last available tag wins).
+// Returns the key tags that didn't survive
+func copyMetadata(src, dst string) (lost []string, err error) {
+	exiftool, err := exiftoolPath()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(exiftool, "-q", "-q", "-m", "-overwrite_original", "-TagsFromFile", src, "-all:all", "-ICC_Profile", "-FileModifyDate<CreateDate", "-FileModifyDate<DateTimeOriginal", dst)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+	tags, err := readMetadata(src, dst)
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range keyMetadataTags {
+		if value, ok := tags[0][tag]; ok && !reflect.DeepEqual(value, tags[1][tag]) {
+			lost = append(lost, tag)
+		}
+	}
+	return lost, nil
+}
+
+// readMetadata Returns the key tags of each file, numeric values aren't formatted so they can be compared
+func readMetadata(files ...string) ([]map[string]any, error) {
+	exiftool, err := exiftoolPath()
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-j", "-n", "-q", "-q"}
+	for _, tag := range keyMetadataTags {
+		args = append(args, "-"+tag)
+	}
+	output, err := exec.Command(exiftool, append(args, files...)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s", err, output)
+	}
+	var tags []map[string]any
+	if err = json.Unmarshal(output, &tags); err != nil {
+		return nil, err
+	}
+	if len(tags) != len(files) {
+		return nil, fmt.Errorf("exiftool returned %d results for %d files", len(tags), len(files))
+	}
+	return tags, nil
+}
+
+// metadataSummary Short description of the verified tags for logs
+func metadataSummary(lost []string) string {
+	if len(lost) == 0 {
+		return "metadata copied"
+	}
+	return "metadata LOST: " + strings.Join(lost, ", ")
+}
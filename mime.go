@@ -0,0 +1,295 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"net/http"
+	"os"
+	"strings"
+)
+
+const sniffLen = 64 << 10
+
+// ftypBrands ISO base media file format major brands. Checked against the ftyp box
+var ftypBrands = map[string]string{
+	"avif": "image/avif",
+	"avis": "image/avif",
+	"heic": "image/heic",
+	"heix": "image/heic",
+	"heim": "image/heic",
+	"heis": "image/heic",
+	"mif1": "image/heif",
+	"msf1": "image/heif",
+	"qt  ": "video/quicktime",
+	"isom": "video/mp4",
+	"iso2": "video/mp4",
+	"mp41": "video/mp4",
+	"mp42": "video/mp4",
+	"avc1": "video/mp4",
+	"M4V ": "video/mp4",
+	"3gp4": "video/3gpp",
+	"3gp5": "video/3gpp",
+}
+
+var jxlContainerSignature = []byte{0x00, 0x00, 0x00, 0x0C, 0x4A, 0x58, 0x4C, 0x20, 0x0D, 0x0A, 0x87, 0x0A}
+var jxlCodestreamSignature = []byte{0xFF, 0x0A}
+
+// ImageFormat Target of download conversions
+type ImageFormat struct {
+	Extension string
+	MimeType  string
+}
+
+var imageFormats = map[string]ImageFormat{
+	"jpeg": {".jpg", "image/jpeg"},
+	"png":  {".png", "image/png"},
+	"webp": {".webp", "image/webp"},
+	"avif": {".avif", "image/avif"},
+	"jxl":  {".jxl", "image/jxl"},
+	"gif":  {".gif", "image/gif"},
+}
+
+// extensionMimeTypes MIME types immich stores for each extension
+var extensionMimeTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".webp": "image/webp",
+	".avif": "image/avif",
+	".jxl":  "image/jxl",
+	".gif":  "image/gif",
+	".heic": "image/heic",
+	".heif": "image/heif",
+	".tif":  "image/tiff",
+	".tiff": "image/tiff",
+	".mp4":  "video/mp4",
+	".mov":  "video/quicktime",
+}
+
+func mimeTypeByExtension(ext string) string {
+	return extensionMimeTypes[strings.ToLower(ext)]
+}
+
+// detectMimeType Detects the MIME type from the first bytes of a file. Knows about the formats immich and IUO tasks deal with
+func detectMimeType(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, jxlContainerSignature), bytes.HasPrefix(head, jxlCodestreamSignature):
+		return "image/jxl"
+	case len(head) >= 12 && bytes.Equal(head[4:8], []byte("ftyp")):
+		if mimeType, ok := ftypBrands[string(head[8:12])]; ok {
+			if mimeType == "image/heif" {
+				return compatibleImageBrand(head, mimeType)
+			}
+			return mimeType
+		}
+	}
+	return strings.Split(http.DetectContentType(head), ";")[0]
+}
+
+// compatibleImageBrand Generic HEIF files (mif1, msf1) list the codec in the compatible brands: size(4) "ftyp" major(4) minor version(4) compatible brands(4 each)
+func compatibleImageBrand(head []byte, mimeType string) string {
+	size := min(int(binary.BigEndian.Uint32(head)), len(head))
+	for offset := 16; offset+4 <= size; offset += 4 {
+		if brand := ftypBrands[string(head[offset:offset+4])]; brand == "image/avif" || brand == "image/heic" {
+			return brand
+		}
+	}
+	return mimeType
+}
+
+// sameImageFamily Reports whether the MIME types are the same container: immich picks image/heic or image/heif from the extension, whatever the brand
+func sameImageFamily(a, b string) bool {
+	family := func(mimeType string) string {
+		if mimeType == "image/heic" {
+			return "image/heif"
+		}
+		return mimeType
+	}
+	return family(a) == family(b)
+}
+
+// hasJPEGReconstruction Reports whether a JXL container holds JPEG reconstruction data (jbrd box): the original JPEG can be rebuilt bit-exact.
+// The box headers are walked through the file, the jbrd box can follow a large metadata box.
+// Boxes: size(4) type(4), size 1 means a 64 bit size follows, size 0 means the box extends to the end of the file
+func hasJPEGReconstruction(name string) bool {
+	file, err := os.Open(name)
+	if err != nil {
+		return false
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	header := make([]byte, 16)
+	if _, err = file.ReadAt(header[:len(jxlContainerSignature)], 0); err != nil || !bytes.Equal(header[:len(jxlContainerSignature)], jxlContainerSignature) {
+		return false
+	}
+	fileSize := uint64(info.Size())
+	for offset := uint64(len(jxlContainerSignature)); offset+8 <= fileSize; {
+		if _, err = file.ReadAt(header[:8], int64(offset)); err != nil {
+			return false
+		}
+		size := uint64(binary.BigEndian.Uint32(header))
+		if string(header[4:8]) == "jbrd" {
+			return true
+		}
+		switch size {
+		case 0:
+			return false
+		case 1:
+			if _, err = file.ReadAt(header[8:16], int64(offset)+8); err != nil {
+				return false
+			}
+			size = binary.BigEndian.Uint64(header[8:])
+		}
+		if size < 8 || size > fileSize-offset {
+			return false
+		}
+		offset += size
+	}
+	return false
+}
+
+// readFileHead Reads up to n bytes from the beginning of the file
+func readFileHead(name string, n int) ([]byte, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	head := make([]byte, n)
+	read, err := file.Read(head)
+	if err != nil && read == 0 {
+		return nil, err
+	}
+	return head[:read], nil
+}
+
+// imageDimensions Returns width and height of JPEG, PNG, GIF, AVIF and HEIC images, 0 if unknown
+func imageDimensions(head []byte, mimeType string) (width, height int) {
+	switch mimeType {
+	case "image/avif", "image/heic", "image/heif":
+		return heifDimensions(head)
+	default:
+		if imageConfig, _, err := image.DecodeConfig(bytes.NewReader(head)); err == nil {
+			return imageConfig.Width, imageConfig.Height
+		}
+	}
+	return 0, 0
+}
+
+// heifDimensions Returns the image spatial extents (ispe) of the primary item: thumbnails and grid tiles have their own.
+// The primary item is in the pitm box, its properties are listed by the ipma box as 1-based indexes into the ipco box
+func heifDimensions(head []byte) (width, height int) {
+	var meta []byte
+	forEachBox(head, func(boxType string, payload []byte) bool {
+		if boxType == "meta" {
+			meta = payload
+		}
+		return meta == nil
+	})
+	// meta is a full box: version(1) flags(3)
+	if len(meta) < 4 {
+		return 0, 0
+	}
+	var primary uint32
+	var ipco, ipma []byte
+	forEachBox(meta[4:], func(boxType string, payload []byte) bool {
+		switch boxType {
+		case "pitm":
+			if len(payload) >= 6 && payload[0] == 0 {
+				primary = uint32(binary.BigEndian.Uint16(payload[4:]))
+			} else if len(payload) >= 8 {
+				primary = binary.BigEndian.Uint32(payload[4:])
+			}
+		case "iprp":
+			forEachBox(payload, func(boxType string, payload []byte) bool {
+				switch boxType {
+				case "ipco":
+					ipco = payload
+				case "ipma":
+					ipma = payload
+				}
+				return true
+			})
+		}
+		return true
+	})
+	var properties []string
+	var extents [][]byte
+	forEachBox(ipco, func(boxType string, payload []byte) bool {
+		properties = append(properties, boxType)
+		extents = append(extents, payload)
+		return true
+	})
+	// ipma: version(1) flags(3) entry_count(4), entries: item_ID(2, 4 if version >= 1) count(1) indexes(1, 2 if flags & 1, the top bit is the essential flag)
+	if primary == 0 || len(ipma) < 8 {
+		return 0, 0
+	}
+	itemSize, indexSize := 2, 1
+	if ipma[0] >= 1 {
+		itemSize = 4
+	}
+	if ipma[3]&1 != 0 {
+		indexSize = 2
+	}
+	entries, offset := binary.BigEndian.Uint32(ipma[4:]), 8
+	for range entries {
+		if offset+itemSize+1 > len(ipma) {
+			return 0, 0
+		}
+		var item uint32
+		if itemSize == 2 {
+			item = uint32(binary.BigEndian.Uint16(ipma[offset:]))
+		} else {
+			item = binary.BigEndian.Uint32(ipma[offset:])
+		}
+		count := int(ipma[offset+itemSize])
+		offset += itemSize + 1
+		if offset+count*indexSize > len(ipma) {
+			return 0, 0
+		}
+		for range count {
+			var index int
+			if indexSize == 2 {
+				index = int(binary.BigEndian.Uint16(ipma[offset:]) & 0x7fff)
+			} else {
+				index = int(ipma[offset] & 0x7f)
+			}
+			offset += indexSize
+			// ispe: version+flags(4) width(4) height(4)
+			if item == primary && index > 0 && index <= len(properties) && properties[index-1] == "ispe" && len(extents[index-1]) >= 12 {
+				return int(binary.BigEndian.Uint32(extents[index-1][4:])), int(binary.BigEndian.Uint32(extents[index-1][8:]))
+			}
+		}
+	}
+	return 0, 0
+}
+
+// forEachBox Calls fn with the type and payload of each ISO base media box in data, until fn returns false or a box is truncated
+func forEachBox(data []byte, fn func(boxType string, payload []byte) bool) {
+	for len(data) >= 8 {
+		size, headerSize := uint64(binary.BigEndian.Uint32(data)), uint64(8)
+		switch size {
+		case 0:
+			size = uint64(len(data))
+		case 1:
+			if len(data) < 16 {
+				return
+			}
+			size, headerSize = binary.BigEndian.Uint64(data[8:]), 16
+		}
+		if size < headerSize || size > uint64(len(data)) {
+			return
+		}
+		if !fn(string(data[4:8]), data[headerSize:size]) {
+			return
+		}
+		data = data[size:]
+	}
+}
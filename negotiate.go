@@ -0,0 +1,135 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// acceptRange A media range of the Accept header
+type acceptRange struct {
+	mimeType string
+	q        float64
+}
+
+func parseAccept(header string) (ranges []acceptRange) {
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		mimeType := strings.ToLower(strings.TrimSpace(params[0]))
+		if mimeType == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if key, value, ok := strings.Cut(strings.TrimSpace(param), "="); ok && strings.ToLower(key) == "q" {
+				if parsed, err := strconv.ParseFloat(value, 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		ranges = append(ranges, acceptRange{mimeType, q})
+	}
+	return
+}
+
+// acceptQuality Returns the quality of the most specific media range matching the MIME type: 2 exact, 1 type/*, 0 */*. specificity is -1 if nothing matches
+func acceptQuality(ranges []acceptRange, mimeType string) (q float64, specificity int) {
+	specificity = -1
+	mainType, _, _ := strings.Cut(mimeType, "/")
+	for _, r := range ranges {
+		s := -1
+		switch r.mimeType {
+		case mimeType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return
+}
+
+// userAgentSupportsHEVC Firefox and Chromium based browsers can't play HEVC on desktop Linux. Apps and other clients are assumed to support it
+func userAgentSupportsHEVC(userAgent string) bool {
+	desktopLinux := strings.Contains(userAgent, "Linux") && !strings.Contains(userAgent, "Android")
+	if strings.Contains(userAgent, "Firefox/") || strings.Contains(userAgent, "Chrome/") {
+		return !desktopLinux
+	}
+	return true
+}
+
+var safariVersionRegex = regexp.MustCompile(`Version/(\d+)[.\d]* (Mobile/\S+ )?Safari/`)
+
+// userAgentSupports Formats supported by browsers that don't always list them in the Accept header
+func userAgentSupports(userAgent, mimeType string) bool {
+	if strings.Contains(userAgent, "Chrome/") || strings.Contains(userAgent, "Chromium/") || strings.Contains(userAgent, "Android") {
+		return false
+	}
+	matches := safariVersionRegex.FindStringSubmatch(userAgent)
+	if matches == nil {
+		return false
+	}
+	version, _ := strconv.Atoi(matches[1])
+	switch mimeType {
+	case "image/jxl":
+		return version >= 17
+	case "image/avif":
+		return version >= 16
+	case "image/heic", "image/heif":
+		return version >= 17
+	}
+	return false
+}
+
+// imageRanges The image media ranges of the Accept header. Navigations list image types whatever is downloaded, they count as listing none like API requests:
+// a link download and the asset info requested by the same client then agree on the format
+func imageRanges(header http.Header) (ranges []acceptRange) {
+	accept := parseAccept(header.Get("Accept"))
+	if header.Get("Sec-Fetch-Dest") == "document" || slices.ContainsFunc(accept, func(r acceptRange) bool { return r.mimeType == "text/html" }) {
+		return nil
+	}
+	for _, r := range accept {
+		if strings.HasPrefix(r.mimeType, "image/") {
+			ranges = append(ranges, r)
+		}
+	}
+	return
+}
+
+// negotiateFormat Picks the download task format that suits the client best. convert is false if the client declares support for the stored MIME type.
+// The asset info advertises the file name of the same negotiation
+func negotiateFormat(header http.Header, storedMimeType string, dt *DownloadTask) (format string, convert bool) {
+	ranges := imageRanges(header)
+	// Wildcards don't count as declaring support for the stored format
+	if q, specificity := acceptQuality(ranges, storedMimeType); (specificity == 2 && q > 0) || userAgentSupports(header.Get("User-Agent"), storedMimeType) {
+		return "", false
+	}
+	if len(ranges) == 0 {
+		return dt.Format, true
+	}
+	// Highest quality first, then the most specific match, then the configured order
+	formats := slices.Clone(dt.Formats)
+	slices.SortStableFunc(formats, func(a, b string) int {
+		qa, sa := acceptQuality(ranges, imageFormats[a].MimeType)
+		qb, sb := acceptQuality(ranges, imageFormats[b].MimeType)
+		switch {
+		case qa != qb && qa > qb:
+			return -1
+		case qa != qb:
+			return 1
+		default:
+			return sb - sa
+		}
+	})
+	if q, specificity := acceptQuality(ranges, imageFormats[formats[0]].MimeType); specificity == -1 || q <= 0 {
+		// Nothing acceptable, the default is still better than the stored format
+		return dt.Format, true
+	}
+	return formats[0], true
+}
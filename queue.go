@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// queueAttempts Number of times a queued job is processed before it's dropped, a failed job is retried after queueRetryDelay times the attempts
+const queueAttempts = 3
+const queueRetryDelay = 10 * time.Minute
+
+// asyncJob An asset uploaded as original by an async task, waiting to be processed and replaced. Saved in <queue_dir>/<id>.json next to the original file.
+// Uploads being processed are saved too with -queue_uploads, they have no asset id until they're replayed after a restart
+type asyncJob struct {
+	ID       string              `json:"id"`
+	Task     string              `json:"task"`
+	AssetID  string              `json:"asset_id"`
+	Filename string              `json:"filename"`
+	File     string              `json:"file"` // Name of the original in the queue directory
+	Checksum string              `json:"checksum"`
+	Header   http.Header         `json:"header"`
+	Form     map[string][]string `json:"form"`
+	Queued   time.Time           `json:"queued"`
+	Attempts int                 `json:"attempts"`
+	Retry    time.Time           `json:"retry"`
+}
+
+var queueLock sync.Mutex
+var queue []*asyncJob
+
+// queueSignal Wakes up the queue worker when a job is added
+var queueSignal = make(chan struct{}, 1)
+
+// scheduleWindow Time of day range, end before start spans midnight
+type scheduleWindow struct {
+	start, end time.Duration
+}
+
+// parseSchedule Parses comma separated HH:MM-HH:MM windows, in local time
+func parseSchedule(schedule string) (windows []scheduleWindow, err error) {
+	if schedule == "" {
+		return nil, nil
+	}
+	for _, window := range strings.Split(schedule, ",") {
+		start, end, ok := strings.Cut(strings.TrimSpace(window), "-")
+		if !ok {
+			return nil, fmt.Errorf("invalid window: %s", window)
+		}
+		var w scheduleWindow
+		if w.start, err = parseTimeOfDay(start); err != nil {
+			return nil, err
+		}
+		if w.end, err = parseTimeOfDay(end); err != nil {
+			return nil, err
+		}
+		if w.start == w.end {
+			return nil, fmt.Errorf("empty window: %s", window)
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(value string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time: %s", value)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// scheduled Whether the task can run at the given time, always if it has no schedule
+func (task *Task) scheduled(now time.Time) bool {
+	if len(task.schedule) == 0 {
+		return true
+	}
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute
+	for _, w := range task.schedule {
+		if w.start < w.end && clock >= w.start && clock < w.end || w.start > w.end && (clock >= w.start || clock < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasAsyncTasks Whether the queue worker is needed
+func hasAsyncTasks() bool {
+	return slices.ContainsFunc(config.Tasks, func(task *Task) bool { return task.Async })
+}
+
+// queueJob Uploads the original right away and queues it for processing, the client doesn't wait for the task.
+// The original is kept in the queue directory until the asset is replaced
+func queueJob(w http.ResponseWriter, r *http.Request, form *uploadForm, tp *TaskProcessor, logger *customLogger) error {
+	_, assetID, err := uploadUpstream(w, r, form.Values, tp.OriginalFile, tp.OriginalFilename)
+	if err != nil {
+		logger.Printf("upload upstream error: %s", err.Error())
+		if !errors.Is(err, errResponseSent) {
+			http.Error(w, "failed to process file, view logs for more info", http.StatusInternalServerError)
+		}
+		return nil
+	}
+	logger.Printf("uploaded original: \"%s\" (%s)", tp.OriginalFilename, humanReadableSize(tp.OriginalSize))
+	if assetID == "" {
+		return nil
+	}
+	queueLock.Lock()
+	queued := slices.ContainsFunc(queue, func(job *asyncJob) bool { return job.AssetID == assetID })
+	queueLock.Unlock()
+	if queued {
+		logger.Printf("asset %s already queued", assetID)
+		return nil
+	}
+	if err = os.MkdirAll(queueDir, 0755); logger.Error(err, "queue") {
+		return nil
+	}
+	file, err := os.CreateTemp(queueDir, "async-*"+tp.OriginalExtension)
+	if logger.Error(err, "queue") {
+		return nil
+	}
+	_ = file.Close()
+	job := newJobRecord(tp, filepath.Base(file.Name()), form.Values, r.Header)
+	job.AssetID = assetID
+	if err = tp.MoveOriginal(job.path()); logger.Error(err, "queue") {
+		_ = os.Remove(file.Name())
+		return nil
+	}
+	if err = saveJob(job); logger.Error(err, "queue") {
+		// Processed anyway, unless IUO restarts
+		logger.Printf("asset %s won't be processed after a restart", assetID)
+	}
+	queueLock.Lock()
+	queue = append(queue, job)
+	queueLock.Unlock()
+	select {
+	case queueSignal <- struct{}{}:
+	default:
+	}
+	if tp.Task.Schedule != "" {
+		logger.Printf("queued: asset %s, task %s runs at %s", assetID, tp.Task.Name, tp.Task.Schedule)
+	} else {
+		logger.Printf("queued: asset %s, task %s", assetID, tp.Task.Name)
+	}
+	return nil
+}
+
+// runQueue Processes the queued jobs one at a time, in upload order. Jobs of tasks outside of their schedule wait for the next window
+func runQueue() {
+	logger := newCustomLogger(baseLogger, "queue: ")
+	for {
+		job := nextJob()
+		if job == nil {
+			// Schedules have a minute resolution
+			select {
+			case <-queueSignal:
+			case <-time.After(time.Minute):
+			}
+			continue
+		}
+		jobLogger := newCustomLogger(logger, fmt.Sprintf("%s: ", job.ID))
+		err := processJob(job, jobLogger)
+		var immichErr *immichError
+		if err != nil && !errors.Is(err, errJobDropped) && !(errors.As(err, &immichErr) && immichErr.StatusCode < 500) && job.Attempts < queueAttempts {
+			job.Retry = time.Now().Add(time.Duration(job.Attempts) * queueRetryDelay)
+			jobLogger.Printf("attempt %d/%d failed, retrying at %s: %v", job.Attempts, queueAttempts, job.Retry.Format(time.TimeOnly), err)
+			jobLogger.Error(saveJob(job), "save")
+			queueLock.Lock()
+			queue = append(queue, job)
+			queueLock.Unlock()
+			continue
+		}
+		if errors.Is(err, errJobDropped) {
+			jobLogger.Printf("%v", err)
+		} else if err != nil {
+			jobLogger.Printf("job dropped after %d attempts: %v", job.Attempts, err)
+		}
+		removeJob(job)
+	}
+}
+
+// nextJob Removes the first job that can run now from the queue, nil if there's none
+func nextJob() *asyncJob {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+	now := time.Now()
+	for i, job := range queue {
+		task := configTask(job.Task)
+		if task != nil && !task.scheduled(now) || now.Before(job.Retry) {
+			continue
+		}
+		queue = slices.Delete(queue, i, i+1)
+		return job
+	}
+	return nil
+}
+
+// configTask Returns the task with this name, nil if it was removed from the tasks file
+func configTask(name string) *Task {
+	for _, task := range config.Tasks {
+		if task.Name == name {
+			return task
+		}
+	}
+	return nil
+}
+
+var errJobDropped = errors.New("job dropped")
+
+// processJob Runs the task on the queued original and replaces the asset if the processed file is smaller.
+// The job is dropped if the asset was deleted or its file changed since the upload
+func processJob(job *asyncJob, logger *customLogger) error {
+	job.Attempts++
+	task := configTask(job.Task)
+	if task == nil {
+		return fmt.Errorf("%w: task %s not found", errJobDropped, job.Task)
+	}
+	if job.AssetID == "" {
+		if err := replayUpload(job, logger); err != nil {
+			return err
+		}
+	}
+	var asset Asset
+	if err := immichJSON("GET", "/api/assets/"+job.AssetID, job.Header, nil, &asset); err != nil {
+		return err
+	}
+	if trashed, _ := asset["isTrashed"].(bool); trashed {
+		return fmt.Errorf("%w: asset trashed", errJobDropped)
+	}
+	if asset["checksum"] != job.Checksum {
+		return fmt.Errorf("%w: the asset file changed since the upload", errJobDropped)
+	}
+	file, err := os.Open(job.path())
+	if err != nil {
+		return fmt.Errorf("%w: %w", errJobDropped, err)
+	}
+	tp, err := NewTaskProcessor(task, file, job.Filename)
+	_ = file.Close()
+	if err != nil {
+		return err
+	}
+	defer tp.Close()
+	tp.SetLogger(newCustomLogger(logger, path.Base(job.Filename)+": "))
+	tp.SetForm(job.Form, job.Header)
+	logger.Printf("processing \"%s\" (%s), queued %s ago", job.Filename, humanReadableSize(tp.OriginalSize), time.Since(job.Queued).Round(time.Second))
+	_, err = optimizeAsset(job.Header, asset, tp, false, logger)
+	return err
+}
+
+// newJobRecord A job for the original of the task processor, file is its name in the queue directory
+func newJobRecord(tp *TaskProcessor, file string, form map[string][]string, header http.Header) *asyncJob {
+	return &asyncJob{
+		ID:       strings.TrimSuffix(file, tp.OriginalExtension),
+		Task:     tp.Task.Name,
+		Filename: tp.OriginalFilename,
+		File:     file,
+		Checksum: tp.OriginalHash,
+		Header:   immichAuthHeader(header),
+		Form:     form,
+		Queued:   time.Now(),
+	}
+}
+
+func (job *asyncJob) path() string {
+	return filepath.Join(queueDir, job.File)
+}
+
+// saveJob Writes the job file atomically. It holds the immich credentials of the user, only the owner can read it
+func saveJob(job *asyncJob) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	name := filepath.Join(queueDir, job.ID+".json")
+	if err = os.WriteFile(name+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(name+".tmp", name)
+}
+
+// removeJob Deletes the job file and the original
+func removeJob(job *asyncJob) {
+	_ = os.Remove(filepath.Join(queueDir, job.ID+".json"))
+	_ = os.Remove(job.path())
+}
+
+// saveUploadJob Records an upload being processed, its original must be in the queue directory. The upload is replayed if IUO restarts before it's done
+func saveUploadJob(tp *TaskProcessor, form map[string][]string, header http.Header) (*asyncJob, error) {
+	job := newJobRecord(tp, filepath.Base(tp.tempOriginalFilePath), form, header)
+	return job, saveJob(job)
+}
+
+// loadQueue Reads the jobs left in the queue directory by the last run. Interrupted uploads are replayed to immich before IUO accepts uploads again,
+// clients retrying them would otherwise race with the replay. Files without a job are removed
+func loadQueue() error {
+	entries, err := os.ReadDir(queueDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	logger := newCustomLogger(baseLogger, "queue: ")
+	var jobs []*asyncJob
+	referenced := map[string]bool{}
+	for _, entry := range entries {
+		name := filepath.Join(queueDir, entry.Name())
+		if filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		var job asyncJob
+		data, err := os.ReadFile(name)
+		if err == nil {
+			err = json.Unmarshal(data, &job)
+		}
+		if err == nil {
+			_, err = os.Stat(job.path())
+		}
+		if err != nil {
+			logger.Printf("%s: %v, removed", entry.Name(), err)
+			_ = os.Remove(name)
+			continue
+		}
+		referenced[job.File] = true
+		jobs = append(jobs, &job)
+	}
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".json" && !referenced[entry.Name()] {
+			_ = os.Remove(filepath.Join(queueDir, entry.Name()))
+		}
+	}
+	slices.SortFunc(jobs, func(a, b *asyncJob) int { return a.Queued.Compare(b.Queued) })
+
+	replayed := 0
+	for _, job := range jobs {
+		if job.AssetID == "" {
+			jobLogger := newCustomLogger(logger, job.ID+": ")
+			// Failed replays are retried by the queue worker
+			if err := replayUpload(job, jobLogger); errors.Is(err, errJobDropped) {
+				jobLogger.Printf("%v", err)
+				removeJob(job)
+				continue
+			} else if !jobLogger.Error(err, "replay") {
+				replayed++
+			}
+		}
+		queue = append(queue, job)
+	}
+	log.Printf("queue: %d jobs resumed, %d interrupted uploads replayed", len(queue), replayed)
+	return nil
+}
+
+// replayUpload Uploads the original of an upload interrupted by a restart, it's then processed like an async job.
+// Nothing is uploaded if the user already has it in immich: the original, or a processed file recorded in the checksums file, after a retry of the client
+func replayUpload(job *asyncJob, logger *customLogger) error {
+	checksums := []string{job.Checksum}
+	mapLock.RLock()
+	for fake, original := range fakeToOriginalChecksum {
+		if original == job.Checksum {
+			checksums = append(checksums, fake)
+		}
+	}
+	mapLock.RUnlock()
+	for _, checksum := range checksums {
+		assets, err := searchAssetsByChecksum(job.Header, checksum)
+		if err != nil {
+			return err
+		}
+		if len(assets) > 0 {
+			return fmt.Errorf("%w: already uploaded as asset %s", errJobDropped, assets[0]["id"])
+		}
+	}
+	fields := map[string]string{}
+	for key, values := range job.Form {
+		if len(values) > 0 {
+			fields[key] = values[0]
+		}
+	}
+	file, err := os.Open(job.path())
+	if err != nil {
+		return fmt.Errorf("%w: %w", errJobDropped, err)
+	}
+	defer file.Close()
+	var result map[string]any
+	if err = immichUpload("POST", "/api/assets", job.Header, fields, job.Filename, file, &result); err != nil {
+		return err
+	}
+	if result["status"] == "duplicate" {
+		return fmt.Errorf("%w: already uploaded as asset %s", errJobDropped, result["id"])
+	}
+	job.AssetID = fmt.Sprint(result["id"])
+	logger.Printf("replayed upload: \"%s\" as asset %s", job.Filename, job.AssetID)
+	return saveJob(job)
+}
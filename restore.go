@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// checksumEntry A record of the checksums file
+type checksumEntry struct {
+	Fake     string
+	Original string
+	Vault    string
+}
+
+// checksumEntries Snapshot of the checksums records, sorted by stored file checksum
+func checksumEntries() (entries []checksumEntry) {
+	mapLock.RLock()
+	defer mapLock.RUnlock()
+	for fake, original := range fakeToOriginalChecksum {
+		entries = append(entries, checksumEntry{fake, original, fakeToVault[fake]})
+	}
+	slices.SortFunc(entries, func(a, b checksumEntry) int { return strings.Compare(a.Fake, b.Fake) })
+	return
+}
+
+// runRestore Replaces the processed files stored in immich with the originals archived in the vault.
+// Restored assets are recorded in the state file, a restore can be interrupted and run again. Records of the checksums file are removed once no user has the processed file anymore
+func runRestore(args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	dryRun := flags.Bool("dry_run", false, "Print the assets that would be restored without changing anything")
+	filter := flags.String("users", "", "Comma separated emails or ids of the users to restore. Default: all the -api_key users")
+	statePath := flags.String("state", "", "File recording the restored assets, to resume an interrupted restore. Default: <checksums_file>.restore")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if vaultLocation == "" {
+		return errors.New("the -vault flag is required")
+	}
+	var err error
+	if vault, err = newVault(vaultLocation); err != nil {
+		return fmt.Errorf("vault: %w", err)
+	}
+	allUsers, err := initCommand()
+	if err != nil {
+		return err
+	}
+	if *statePath == "" {
+		*statePath = checksumsFile + ".restore"
+	}
+	state, err := readCommandState(*statePath)
+	if err != nil {
+		return err
+	}
+	stateFile, err := os.OpenFile(*statePath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer stateFile.Close()
+
+	restored, failed := 0, 0
+	for _, user := range selectUsers(allUsers, *filter) {
+		for _, entry := range checksumEntries() {
+			if entry.Vault == "" || state[user.ID+" "+entry.Fake] {
+				continue
+			}
+			assets, err := searchAssetsByChecksum(user.Header, entry.Fake)
+			if err != nil {
+				log.Printf("%s: %s: search: %v", user.Email, entry.Fake, err)
+				failed++
+				continue
+			}
+			done := len(assets) > 0
+			for _, asset := range assets {
+				if *dryRun {
+					log.Printf("%s: would restore %s (%s) from %s", user.Email, asset["originalFileName"], asset["id"], entry.Vault)
+					restored++
+					continue
+				}
+				if err = restoreAsset(user.Header, asset, entry); err != nil {
+					log.Printf("%s: %s (%s): %v", user.Email, asset["originalFileName"], asset["id"], err)
+					failed++
+					done = false
+					continue
+				}
+				log.Printf("%s: restored %s (%s)", user.Email, asset["originalFileName"], asset["id"])
+				restored++
+			}
+			if done && !*dryRun {
+				if _, err = fmt.Fprintf(stateFile, "%s %s\n", user.ID, entry.Fake); err != nil {
+					return err
+				}
+				state[user.ID+" "+entry.Fake] = true
+			}
+		}
+	}
+	if *dryRun {
+		log.Printf("%d assets would be restored", restored)
+		return nil
+	}
+
+	// The checksums record is still needed as long as a user has the processed file
+	unused := map[string]bool{}
+	for key := range state {
+		_, fake, _ := strings.Cut(key, " ")
+		if _, ok := originalChecksum(fake); ok && !unused[fake] && !checksumInUse(allUsers, fake) {
+			unused[fake] = true
+		}
+	}
+	if err = removeChecksums(unused); err != nil {
+		return fmt.Errorf("unable to update the checksums file: %w", err)
+	}
+	log.Printf("%d assets restored, %d failed, %d checksums records removed", restored, failed, len(unused))
+	if failed > 0 {
+		return fmt.Errorf("%d assets failed, run the command again to retry", failed)
+	}
+	return nil
+}
+
+// checksumInUse Reports whether a user still has an asset with the checksum, trashed assets and errors count as in use
+func checksumInUse(users []*commandUser, checksum string) bool {
+	for _, user := range users {
+		// A trashed asset can still be restored from the trash and downloaded
+		filters := map[string]any{"checksum": checksum, "withDeleted": true}
+		if assets, _, err := searchAssetsPage(user.Header, filters, 1, 1); err != nil || len(assets) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// readCommandState Reads the lines of a state file, missing files are empty
+func readCommandState(name string) (map[string]bool, error) {
+	state := map[string]bool{}
+	file, err := os.Open(name)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			state[line] = true
+		}
+	}
+	return state, scanner.Err()
+}
+
+// restoreAsset Replaces the asset file with the original from the vault
+func restoreAsset(header http.Header, asset Asset, entry checksumEntry) error {
+	original, filename, err := fetchVaultOriginal(entry)
+	if err != nil {
+		return err
+	}
+	defer func() { original.Close(); _ = os.Remove(original.Name()) }()
+	_, err = replaceAsset(header, asset, original, filename)
+	return err
+}
+
+// fetchVaultOriginal Downloads the original to a temp file and checks its checksum
+func fetchVaultOriginal(entry checksumEntry) (*os.File, string, error) {
+	reader, object, err := vault.Get(entry.Vault)
+	if err != nil {
+		return nil, "", err
+	}
+	defer reader.Close()
+	file, err := os.CreateTemp("", "restore-*")
+	if err != nil {
+		return nil, "", err
+	}
+	hasher := sha1.New()
+	if _, err = io.Copy(file, io.TeeReader(reader, hasher)); err == nil && encodeChecksum(hasher) != entry.Original {
+		err = fmt.Errorf("%s doesn't match the original checksum %s", entry.Vault, entry.Original)
+	}
+	if err == nil {
+		_, err = file.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		file.Close()
+		_ = os.Remove(file.Name())
+		return nil, "", err
+	}
+	return file, object.Filename, nil
+}
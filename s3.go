@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Vault Stores originals in an S3 compatible bucket (AWS, MinIO, Garage...), requests are signed with AWS Signature Version 4.
+// Path style URLs are used, the object description is stored as object metadata
+type s3Vault struct {
+	endpoint  string
+	region    string
+	accessKey string
+	secretKey string
+	bucket    string
+	prefix    string
+}
+
+// unsignedPayload The body isn't part of the signature, originals are streamed from disk without being read twice
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+func newS3Vault(bucket, prefix string) (*s3Vault, error) {
+	if vaultS3Endpoint == "" {
+		return nil, errors.New("vault_s3_endpoint is required")
+	}
+	if vaultS3AccessKey == "" || vaultS3SecretKey == "" {
+		return nil, errors.New("vault_s3_access_key and vault_s3_secret_key are required")
+	}
+	if prefix != "" {
+		prefix += "/"
+	}
+	return &s3Vault{
+		endpoint:  strings.TrimSuffix(vaultS3Endpoint, "/"),
+		region:    vaultS3Region,
+		accessKey: vaultS3AccessKey,
+		secretKey: vaultS3SecretKey,
+		bucket:    bucket,
+		prefix:    prefix,
+	}, nil
+}
+
+// s3MaxPutSize Objects bigger than this can't be uploaded with a single PUT
+const s3MaxPutSize = 5 << 30
+
+// s3PartSize Minimum part size of multipart uploads, bigger for files that would need more than s3MaxParts parts
+const (
+	s3PartSize = 64 << 20
+	s3MaxParts = 10000
+)
+
+func (v *s3Vault) Put(key string, file *os.File, object VaultObject) (string, error) {
+	if object.Size > s3MaxPutSize {
+		if err := v.putMultipart(v.prefix+key, file, object); err != nil {
+			return "", err
+		}
+		return "s3://" + v.bucket + "/" + v.prefix + key, nil
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	req, err := v.request("PUT", v.prefix+key, nil, io.NopCloser(file))
+	if err != nil {
+		return "", err
+	}
+	req.ContentLength = object.Size
+	setObjectHeaders(req.Header, object)
+	resp, err := v.do(req)
+	if err != nil {
+		return "", err
+	}
+	_ = resp.Body.Close()
+	return "s3://" + v.bucket + "/" + v.prefix + key, nil
+}
+
+// setObjectHeaders Content type and description of the object, set when it's created
+func setObjectHeaders(header http.Header, object VaultObject) {
+	header.Set("Content-Type", object.ContentType)
+	// Metadata values must be ASCII
+	header.Set("X-Amz-Meta-Filename", url.PathEscape(object.Filename))
+	if !object.Expires.IsZero() {
+		header.Set("X-Amz-Meta-Expires", object.Expires.UTC().Format(time.RFC3339))
+	}
+}
+
+type s3CompletedPart struct {
+	PartNumber int
+	ETag       string
+}
+
+// putMultipart Uploads the file in parts, the upload is aborted on error so the bucket doesn't keep the parts
+func (v *s3Vault) putMultipart(key string, file *os.File, object VaultObject) (err error) {
+	req, err := v.request("POST", key, url.Values{"uploads": {""}}, nil)
+	if err != nil {
+		return err
+	}
+	setObjectHeaders(req.Header, object)
+	resp, err := v.do(req)
+	if err != nil {
+		return err
+	}
+	var initiated struct {
+		UploadId string
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&initiated)
+	_ = resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3 initiate multipart upload: %w", err)
+	}
+	defer func() {
+		if err != nil {
+			if req, abortErr := v.request("DELETE", key, url.Values{"uploadId": {initiated.UploadId}}, nil); abortErr == nil {
+				if resp, abortErr := v.do(req); abortErr == nil {
+					_ = resp.Body.Close()
+				}
+			}
+		}
+	}()
+
+	partSize := max(int64(s3PartSize), (object.Size+s3MaxParts-1)/s3MaxParts)
+	var completed struct {
+		XMLName xml.Name          `xml:"CompleteMultipartUpload"`
+		Parts   []s3CompletedPart `xml:"Part"`
+	}
+	for offset, number := int64(0), 1; offset < object.Size; offset, number = offset+partSize, number+1 {
+		size := min(partSize, object.Size-offset)
+		query := url.Values{"partNumber": {strconv.Itoa(number)}, "uploadId": {initiated.UploadId}}
+		if req, err = v.request("PUT", key, query, io.NopCloser(io.NewSectionReader(file, offset, size))); err != nil {
+			return err
+		}
+		req.ContentLength = size
+		if resp, err = v.do(req); err != nil {
+			return err
+		}
+		_ = resp.Body.Close()
+		completed.Parts = append(completed.Parts, s3CompletedPart{number, resp.Header.Get("ETag")})
+	}
+
+	body, err := xml.Marshal(completed)
+	if err != nil {
+		return err
+	}
+	if req, err = v.request("POST", key, url.Values{"uploadId": {initiated.UploadId}}, io.NopCloser(bytes.NewReader(body))); err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(body))
+	if resp, err = v.do(req); err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	// Completion can fail after a 200 status, the error is in the body
+	var result struct {
+		XMLName xml.Name
+		Code    string
+		Message string
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("s3 complete multipart upload: %w", err)
+	}
+	if result.XMLName.Local == "Error" {
+		return fmt.Errorf("s3 complete multipart upload: %s: %s", result.Code, result.Message)
+	}
+	return nil
+}
+
+func (v *s3Vault) Get(location string) (io.ReadCloser, *VaultObject, error) {
+	key, ok := strings.CutPrefix(location, "s3://"+v.bucket+"/")
+	if !ok {
+		return nil, nil, fmt.Errorf("%s isn't in the bucket %s", location, v.bucket)
+	}
+	req, err := v.request("GET", key, nil, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	resp, err := v.do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	filename, err := url.PathUnescape(resp.Header.Get("X-Amz-Meta-Filename"))
+	if err != nil || filename == "" {
+		filename = path.Base(key)
+	}
+	object := &VaultObject{
+		Filename:    filename,
+		ContentType: resp.Header.Get("Content-Type"),
+		Size:        resp.ContentLength,
+	}
+	if object.ContentType == "" {
+		object.ContentType = "application/octet-stream"
+	}
+	return resp.Body, object, nil
+}
+
+func (v *s3Vault) Delete(location string) error {
+	key, ok := strings.CutPrefix(location, "s3://"+v.bucket+"/")
+	if !ok {
+		return fmt.Errorf("%s isn't in the bucket %s", location, v.bucket)
+	}
+	return v.delete(key)
+}
+
+func (v *s3Vault) Prune(before time.Time) (count int, err error) {
+	today := before.UTC().Format(vaultDateLayout)
+	query := url.Values{"list-type": {"2"}, "prefix": {v.prefix + "expires/"}}
+	for {
+		var list s3ListBucketResult
+		if err = v.list(query, &list); err != nil {
+			return count, err
+		}
+		for _, object := range list.Contents {
+			date, _, _ := strings.Cut(strings.TrimPrefix(object.Key, v.prefix+"expires/"), "/")
+			if date >= today {
+				continue
+			}
+			if err = v.delete(object.Key); err != nil {
+				return count, err
+			}
+			count++
+		}
+		if !list.IsTruncated {
+			return count, nil
+		}
+		query.Set("continuation-token", list.NextContinuationToken)
+	}
+}
+
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string
+	}
+	IsTruncated           bool
+	NextContinuationToken string
+}
+
+func (v *s3Vault) list(query url.Values, result *s3ListBucketResult) error {
+	req, err := v.request("GET", "", query, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return xml.NewDecoder(resp.Body).Decode(result)
+}
+
+func (v *s3Vault) delete(key string) error {
+	req, err := v.request("DELETE", key, nil, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.do(req)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+// request Builds a request to the object key, or to the bucket if key is empty
+func (v *s3Vault) request(method, key string, query url.Values, body io.ReadCloser) (*http.Request, error) {
+	u, err := url.Parse(v.endpoint)
+	if err != nil {
+		return nil, err
+	}
+	u.Path = "/" + v.bucket + "/" + key
+	u.RawQuery = s3Encode(query)
+	return http.NewRequest(method, u.String(), body)
+}
+
+// do Signs and sends the request, non 2xx responses are errors
+func (v *s3Vault) do(req *http.Request) (*http.Response, error) {
+	signV4(req, v.accessKey, v.secretKey, v.region, "s3", unsignedPayload, time.Now())
+	resp, err := getHTTPclient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, body)
+	}
+	return resp, nil
+}
+
+// signV4 Adds the AWS Signature Version 4 Authorization header. Every header already set on the request is signed
+func signV4(req *http.Request, accessKey, secretKey, region, service, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+
+	headers := map[string]string{"host": req.URL.Host}
+	for key, values := range req.Header {
+		headers[strings.ToLower(key)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		s3URIEncode(req.URL.Path, false),
+		s3Encode(req.URL.Query()),
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + region + "/" + service + "/aws4_request"
+	canonicalHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + secretKey)
+	for _, part := range []string{date, region, service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+accessKey+"/"+scope+", SignedHeaders="+signedHeaders+", Signature="+signature)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3Encode Sorted query string, encoded as required by the signature: spaces as %20, only unreserved characters left as is
+func s3Encode(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := query[key]
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3URIEncode(key, true)+"="+s3URIEncode(value, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// s3URIEncode URI encodes everything but unreserved characters, slashes are kept in paths
+func s3URIEncode(s string, encodeSlash bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(s) {
+		if 'A' <= b && b <= 'Z' || 'a' <= b && b <= 'z' || '0' <= b && b <= '9' || b == '-' || b == '_' || b == '.' || b == '~' || b == '/' && !encodeSlash {
+			encoded.WriteByte(b)
+		} else {
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
@@ -2,15 +2,19 @@ package main
 
 import (
 	"bytes"
+	"crypto/sha1"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
-	"mime/multipart"
+	"net/http"
 	"os"
 	"os/exec"
 	"path"
 	"slices"
 	"strings"
+	"sync"
+	"time"
 )
 
 type TaskProcessor struct {
@@ -19,6 +23,7 @@ type TaskProcessor struct {
 	OriginalFilename  string
 	OriginalExtension string
 	OriginalSize      int64
+	OriginalHash      string
 
 	tempOriginalFilePath string
 
@@ -26,14 +31,22 @@ type TaskProcessor struct {
 	ProcessedFilename  string
 	ProcessedExtension string
 	ProcessedSize      int64
+	ProcessedStream    io.Reader
 
 	tempWorkDir string
+	streamWait  func() error
+	streamKill  func()
+
+	formValues    map[string][]string
+	requestHeader http.Header
+	user          map[string]any
 
 	logger *customLogger
 }
 
-func NewTaskProcessorFromMultipart(file multipart.File, header *multipart.FileHeader) (*TaskProcessor, error) {
-	originalExtension := path.Ext(header.Filename)
+// findTask Returns the first task matching the file extension. size is ignored when unknown (-1)
+func findTask(filename string, size int64) (*Task, error) {
+	originalExtension := path.Ext(filename)
 	if !isValidFilename(originalExtension) {
 		return nil, fmt.Errorf("invalid file extension: %s", originalExtension)
 	}
@@ -51,26 +64,41 @@ func NewTaskProcessorFromMultipart(file multipart.File, header *multipart.FileHe
 		return nil, fmt.Errorf("no task found for file extension .%s", checkExt)
 	}
 
-	if header.Size < task.MinFilesizeBytes {
-		return nil, fmt.Errorf("file size is smaller than minimum: %d < %d", header.Size, task.MinFilesizeBytes)
+	if size >= 0 && size < task.MinFilesizeBytes {
+		return nil, fmt.Errorf("file size is smaller than minimum: %d < %d", size, task.MinFilesizeBytes)
 	}
 
-	originalFile, err := os.CreateTemp("", "upload-*"+originalExtension)
+	return task, nil
+}
+
+func NewTaskProcessor(task *Task, file io.Reader, filename string) (*TaskProcessor, error) {
+	return NewTaskProcessorIn("", task, file, filename)
+}
+
+// NewTaskProcessorIn Writes the original to dir instead of the temp directory
+func NewTaskProcessorIn(dir string, task *Task, file io.Reader, filename string) (*TaskProcessor, error) {
+	originalExtension := path.Ext(filename)
+	originalFile, err := os.CreateTemp(dir, "upload-*"+originalExtension)
 	if err != nil {
 		return nil, fmt.Errorf("unable to create temp file: %w", err)
 	}
 
-	_, err = io.Copy(originalFile, file)
+	// Hash while writing to scratch, the original is never read back just to compute its checksum
+	hasher := sha1.New()
+	size, err := io.Copy(originalFile, io.TeeReader(file, hasher))
 	if err != nil {
+		_ = originalFile.Close()
+		_ = os.Remove(originalFile.Name())
 		return nil, fmt.Errorf("unable to write temp file: %w", err)
 	}
 
 	return &TaskProcessor{
 		Task:                 task,
 		OriginalFile:         originalFile,
-		OriginalFilename:     header.Filename,
+		OriginalFilename:     filename,
 		OriginalExtension:    originalExtension,
-		OriginalSize:         header.Size,
+		OriginalSize:         size,
+		OriginalHash:         encodeChecksum(hasher),
 		tempOriginalFilePath: originalFile.Name(),
 	}, nil
 }
@@ -86,6 +114,9 @@ func (tp *TaskProcessor) logf(str string, args ...interface{}) {
 }
 
 func (tp *TaskProcessor) Close() error {
+	if tp.streamKill != nil {
+		tp.streamKill()
+	}
 	_ = tp.CleanOriginalFile()
 	return tp.CleanWorkDir()
 }
@@ -109,6 +140,33 @@ func (tp *TaskProcessor) CleanOriginalFile() (err error) {
 	return
 }
 
+// KeepOriginal Closes the original file and leaves it on disk, it isn't removed by Close anymore
+func (tp *TaskProcessor) KeepOriginal() {
+	if tp.OriginalFile != nil {
+		_ = tp.OriginalFile.Close()
+		tp.OriginalFile = nil
+	}
+	tp.tempOriginalFilePath = ""
+}
+
+// MoveOriginal Moves the original file to dst, it isn't removed by Close anymore
+func (tp *TaskProcessor) MoveOriginal(dst string) error {
+	if tp.OriginalFile != nil {
+		_ = tp.OriginalFile.Close()
+		tp.OriginalFile = nil
+	}
+	// Rename fails across file systems (e.g. from tmpfs), the temp file is then removed by Close
+	if err := os.Rename(tp.tempOriginalFilePath, dst); err != nil {
+		if err = copyFile(tp.tempOriginalFilePath, dst); err != nil {
+			_ = os.Remove(dst)
+			return err
+		}
+		return nil
+	}
+	tp.tempOriginalFilePath = ""
+	return nil
+}
+
 func (tp *TaskProcessor) CleanWorkDir() error {
 	if tp.tempWorkDir == "" {
 		return nil
@@ -121,7 +179,194 @@ func (tp *TaskProcessor) CleanWorkDir() error {
 	return err
 }
 
+// SetForm Makes the upload form values and the immich user available to the task templates
+func (tp *TaskProcessor) SetForm(values map[string][]string, header http.Header) {
+	tp.formValues = values
+	tp.requestHeader = header
+}
+
+// templateValues Values available in the task templates, sampleTemplateValues must have the same keys
+func (tp *TaskProcessor) templateValues(resultFolder string) map[string]any {
+	basename := path.Base(tp.tempOriginalFilePath)
+	extension := path.Ext(basename)
+	values := map[string]any{
+		"result_folder":     resultFolder,
+		"original_name":     base64.StdEncoding.EncodeToString([]byte(tp.OriginalFilename)),
+		"original_filename": tp.OriginalFilename,
+		"folder":            path.Dir(tp.tempOriginalFilePath),
+		"name":              strings.TrimSuffix(basename, extension),
+		"extension":         strings.TrimPrefix(extension, "."),
+		"size":              tp.OriginalSize,
+		"mime":              "application/octet-stream",
+		"width":             0,
+		"height":            0,
+		"form":              map[string]string{},
+		"user":              map[string]any{},
+		"params":            tp.Task.Params,
+	}
+	if head, err := readFileHead(tp.tempOriginalFilePath, sniffLen); err == nil {
+		mimeType := detectMimeType(head)
+		values["mime"] = mimeType
+		values["width"], values["height"] = imageDimensions(head, mimeType)
+	}
+	form := values["form"].(map[string]string)
+	for key, formValues := range tp.formValues {
+		if len(formValues) > 0 {
+			form[key] = formValues[0]
+		}
+	}
+	if tp.Task.usesUser && tp.requestHeader != nil && tp.user == nil {
+		if user, err := getImmichUser(tp.requestHeader); err == nil {
+			tp.user = user
+		} else {
+			tp.logf("unable to get immich user: %v", err)
+		}
+	}
+	if tp.user != nil {
+		values["user"] = tp.user
+	}
+	return values
+}
+
+// render Executes the task templates. args is nil for a shell command
+func (tp *TaskProcessor) render(values map[string]any) (args []string, cmdLine string, err error) {
+	if len(tp.Task.ArgsTemplates) > 0 {
+		// Each argument is templated separately and passed as is, no shell involved
+		args = make([]string, len(tp.Task.ArgsTemplates))
+		for i, argTemplate := range tp.Task.ArgsTemplates {
+			var arg bytes.Buffer
+			if err := argTemplate.Execute(&arg, values); err != nil {
+				return nil, "", fmt.Errorf("unable to generate args[%d] to be Run: %w", i, err)
+			}
+			args[i] = arg.String()
+		}
+		return args, shellJoin(args), nil
+	}
+
+	var command bytes.Buffer
+	if err := tp.Task.CommandTemplate.Execute(&command, values); err != nil {
+		return nil, "", fmt.Errorf("unable to generate command to be Run: %w", err)
+	}
+	return nil, command.String(), nil
+}
+
+func (tp *TaskProcessor) command(resultFolder string) (*exec.Cmd, string, error) {
+	args, cmdLine, err := tp.render(tp.templateValues(resultFolder))
+	if err != nil {
+		return nil, "", err
+	}
+	cmd := exec.Command("sh", "-c", cmdLine)
+	if args != nil {
+		cmd = exec.Command(args[0], args[1:]...)
+	}
+	cmd.Dir = path.Dir(configFile)
+	return cmd, cmdLine, nil
+}
+
+// processingCacheKey The original checksum and the command run on it, with the temp paths left out: uploads of the same file share the key
+// unless the task uses values that differ, like the file name or the user
+func (tp *TaskProcessor) processingCacheKey() (string, error) {
+	values := tp.templateValues("result_folder")
+	values["folder"], values["name"] = "folder", "original"
+	_, cmdLine, err := tp.render(values)
+	if err != nil {
+		return "", err
+	}
+	return cacheKey(tp.OriginalHash, version, tp.Task.IO, cmdLine), nil
+}
+
 func (tp *TaskProcessor) Run() error {
+	processedFilePath, err := tp.runCached()
+	if err != nil {
+		return err
+	}
+	tp.ProcessedFile, err = os.Open(processedFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to open temp file: %w", err)
+	}
+	stat, err := os.Stat(processedFilePath)
+	if err != nil {
+		return fmt.Errorf("unable to get file size: %w", err)
+	}
+	tp.ProcessedSize = stat.Size()
+	tp.ProcessedExtension = path.Ext(processedFilePath)
+	tp.ProcessedFilename = strings.TrimSuffix(tp.OriginalFilename, tp.OriginalExtension) + tp.ProcessedExtension
+
+	return nil
+}
+
+// runCached Returns the output of a previous run of the same command on the same original if it's in the processing cache,
+// runs the command otherwise. The output is in the work dir, the cached file can be evicted. The cache is best effort: its failures run the command
+func (tp *TaskProcessor) runCached() (string, error) {
+	if processingCache == nil {
+		return tp.runCommand()
+	}
+	key, err := tp.processingCacheKey()
+	if err != nil {
+		return "", err
+	}
+	ran := false
+	var processedFilePath string
+	var runErr error
+	cached, err := processingCache.Do(key, func() (string, error) {
+		ran = true
+		processedFilePath, runErr = tp.runCommand()
+		return processedFilePath, runErr
+	})
+	hits, misses, ratio := processingCache.HitRate()
+	if ran {
+		if cached != nil {
+			_ = cached.Close()
+		}
+		if runErr != nil {
+			return "", runErr
+		}
+		// The output is still in the work dir, the cache has its own copy
+		tp.logf("processing cache miss: %s, hit rate %.0f%% (%d/%d)", tp.OriginalHash, ratio*100, hits, hits+misses)
+		return processedFilePath, nil
+	}
+	if err != nil {
+		// Another upload of the same file failed: this one still runs the command
+		tp.logf("processing cache: %v, running the task", err)
+		return tp.runCommand()
+	}
+	defer cached.Close()
+	tp.logf("processing cache hit: %s, hit rate %.0f%% (%d/%d)", tp.OriginalHash, ratio*100, hits, hits+misses)
+	if processedFilePath, err = tp.copyCached(cached); err != nil {
+		tp.logf("processing cache: %v, running the task", err)
+		return tp.runCommand()
+	}
+	return processedFilePath, nil
+}
+
+// copyCached Hard links or copies the cached file to the work dir. The opened file is read if it's been evicted in the meantime
+func (tp *TaskProcessor) copyCached(cached *os.File) (string, error) {
+	var err error
+	if tp.tempWorkDir, err = os.MkdirTemp("", "processing-*"); err != nil {
+		return "", fmt.Errorf("unable to create temp folder: %w", err)
+	}
+	processedFilePath := path.Join(tp.tempWorkDir, "processed"+path.Ext(cached.Name()))
+	if os.Link(cached.Name(), processedFilePath) == nil {
+		return processedFilePath, nil
+	}
+	out, err := os.Create(processedFilePath)
+	if err == nil {
+		if _, err = io.Copy(out, cached); err != nil {
+			_ = out.Close()
+		} else {
+			err = out.Close()
+		}
+	}
+	if err != nil {
+		_ = os.RemoveAll(tp.tempWorkDir)
+		tp.tempWorkDir = ""
+		return "", fmt.Errorf("unable to copy cached file: %w", err)
+	}
+	return processedFilePath, nil
+}
+
+// runCommand Runs the task command, returns the path of the single file it outputs in the work dir
+func (tp *TaskProcessor) runCommand() (string, error) {
 	// Limit the number of concurrent tasks running
 	semaphore <- struct{}{}
 	defer func() { <-semaphore }()
@@ -129,53 +374,161 @@ func (tp *TaskProcessor) Run() error {
 
 	tp.tempWorkDir, err = os.MkdirTemp("", "processing-*")
 	if err != nil {
-		return fmt.Errorf("unable to create temp folder: %w", err)
-	}
-
-	basename := path.Base(tp.tempOriginalFilePath)
-	extension := path.Ext(basename)
-	values := map[string]string{
-		"result_folder": tp.tempWorkDir,
-		"original_name": base64.StdEncoding.EncodeToString([]byte(tp.OriginalFilename)),
-		"folder":        path.Dir(tp.tempOriginalFilePath),
-		"name":          strings.TrimSuffix(basename, extension),
-		"extension":     strings.TrimPrefix(extension, "."),
+		return "", fmt.Errorf("unable to create temp folder: %w", err)
 	}
 
-	var cmdLine bytes.Buffer
-	err = tp.Task.CommandTemplate.Execute(&cmdLine, values)
+	cmd, cmdLine, err := tp.command(tp.tempWorkDir)
 	if err != nil {
-		return fmt.Errorf("unable to generate command to be Run: %w", err)
+		return "", err
 	}
-	tp.logf("running task: %s: %s", tp.Task.Name, cmdLine.String())
-	cmd := exec.Command("sh", "-c", cmdLine.String())
-	cmd.Dir = path.Dir(configFile)
+	tp.logf("running task: %s: %s", tp.Task.Name, cmdLine)
 	output, err := cmd.CombinedOutput()
 	if err != nil {
-		return fmt.Errorf("%w while running command:\n%s\nOutput:\n%s", err, cmdLine.String(), string(output))
+		return "", fmt.Errorf("%w while running command:\n%s\nOutput:\n%s", err, cmdLine, string(output))
 	}
 
 	files, err := os.ReadDir(tp.tempWorkDir)
 	if err != nil {
-		return fmt.Errorf("unable to read temp directory: %w", err)
+		return "", fmt.Errorf("unable to read temp directory: %w", err)
 	}
 
 	if len(files) != 1 {
-		return fmt.Errorf("unexpected number of files in temp directory: %d", len(files))
+		return "", fmt.Errorf("unexpected number of files in temp directory: %d", len(files))
 	}
 
-	processedFilePath := path.Join(tp.tempWorkDir, files[0].Name())
-	tp.ProcessedFile, err = os.Open(processedFilePath)
+	return path.Join(tp.tempWorkDir, files[0].Name()), nil
+}
+
+var errReconstructionMismatch = errors.New("reconstructed JPEG doesn't match the original")
+
+// VerifyReconstruction Decodes the processed JXL back to JPEG and compares it with the original, bit by bit. Does nothing unless the task has verify_reconstruction
+func (tp *TaskProcessor) VerifyReconstruction() error {
+	if !tp.Task.VerifyReconstruction {
+		return nil
+	}
+	semaphore <- struct{}{}
+	defer func() { <-semaphore }()
+	converted, _, err := jpegReconstructionTask().Convert(tp.ProcessedFile.Name(), "", "image/jxl", "jpeg", tp.logger)
 	if err != nil {
-		return fmt.Errorf("unable to open temp file: %w", err)
+		return err
 	}
-	stat, err := os.Stat(processedFilePath)
+	defer os.Remove(converted)
+	checksum, err := fileChecksum(converted)
 	if err != nil {
-		err = fmt.Errorf("unable to get file size: %w", err)
+		return err
 	}
-	tp.ProcessedSize = stat.Size()
-	tp.ProcessedExtension = path.Ext(processedFilePath)
+	if checksum != tp.OriginalHash {
+		return fmt.Errorf("%w: %s != %s", errReconstructionMismatch, checksum, tp.OriginalHash)
+	}
+	tp.logf("reconstruction verified: bit-exact original")
+	return nil
+}
+
+var errStreamTooLarge = errors.New("stream output isn't smaller than the original")
+var errStreamFailed = errors.New("stream command failed")
+
+// RunStream Starts a streaming task: the original file is piped to stdin and stdout is exposed as ProcessedStream.
+// Up to Task.StreamBufferBytes of output are buffered in RAM, if the command finishes within the buffer the output size is known before uploading.
+// Otherwise ProcessedStream fails with errStreamTooLarge as soon as the output reaches the original size, so the upload can be aborted and the original sent instead.
+// ProcessedStream is nil if the output is already known not to be smaller. Close must be called to stop the command
+func (tp *TaskProcessor) RunStream() error {
+	// Limit the number of concurrent tasks running, released when the command exits
+	semaphore <- struct{}{}
+	var err error
+
+	cmd, cmdLine, err := tp.command("")
+	if err != nil {
+		<-semaphore
+		return err
+	}
+	if _, err = tp.OriginalFile.Seek(0, io.SeekStart); err != nil {
+		<-semaphore
+		return fmt.Errorf("unable to seek beginning of file: %w", err)
+	}
+	var stderr bytes.Buffer
+	cmd.Stdin = tp.OriginalFile
+	cmd.Stderr = &stderr
+	// Children of a killed command (e.g. sh -c) can keep stderr open: Wait must not block on them
+	cmd.WaitDelay = 5 * time.Second
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		<-semaphore
+		return fmt.Errorf("unable to create stdout pipe: %w", err)
+	}
+	tp.logf("running stream task: %s: %s", tp.Task.Name, cmdLine)
+	if err = cmd.Start(); err != nil {
+		<-semaphore
+		return fmt.Errorf("%w while starting command:\n%s", err, cmdLine)
+	}
+	var waitOnce sync.Once
+	var waitErr error
+	tp.streamWait = func() error {
+		waitOnce.Do(func() {
+			if waitErr = cmd.Wait(); waitErr != nil {
+				waitErr = fmt.Errorf("%w: %w while running command:\n%s\nOutput:\n%s", errStreamFailed, waitErr, cmdLine, stderr.String())
+			}
+			<-semaphore
+		})
+		return waitErr
+	}
+	tp.streamKill = func() {
+		_ = cmd.Process.Kill()
+		_ = tp.streamWait()
+	}
+
+	tp.ProcessedExtension = "." + tp.Task.OutputExtension
 	tp.ProcessedFilename = strings.TrimSuffix(tp.OriginalFilename, tp.OriginalExtension) + tp.ProcessedExtension
 
+	// Output can't be bigger than the original, buffering more than that is useless
+	buf := make([]byte, min(tp.Task.StreamBufferBytes, tp.OriginalSize+1))
+	n, err := io.ReadFull(stdout, buf)
+	switch {
+	case errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF):
+		// Whole output fits in the buffer
+		if err = tp.streamWait(); err != nil {
+			return err
+		}
+		tp.ProcessedSize = int64(n)
+		if tp.ProcessedSize < tp.OriginalSize {
+			tp.ProcessedStream = bytes.NewReader(buf[:n])
+		}
+		return nil
+	case err != nil:
+		tp.streamKill()
+		return fmt.Errorf("unable to read command output: %w", err)
+	case int64(n) > tp.OriginalSize:
+		tp.streamKill()
+		tp.ProcessedSize = int64(n)
+		return nil
+	}
+	// Buffer is full, stream the rest of the output while it's being produced
+	tp.ProcessedStream = &streamOutput{
+		reader: io.MultiReader(bytes.NewReader(buf), stdout),
+		limit:  tp.OriginalSize,
+		size:   &tp.ProcessedSize,
+		wait:   tp.streamWait,
+	}
 	return nil
 }
+
+// streamOutput Reads the command stdout, fails once the output reaches the limit or if the command exits with an error
+type streamOutput struct {
+	reader io.Reader
+	limit  int64
+	size   *int64
+	wait   func() error
+}
+
+func (so *streamOutput) Read(p []byte) (n int, err error) {
+	n, err = so.reader.Read(p)
+	*so.size += int64(n)
+	if *so.size >= so.limit {
+		return n, errStreamTooLarge
+	}
+	if errors.Is(err, io.EOF) {
+		if waitErr := so.wait(); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return
+}
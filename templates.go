@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"text/template"
+	"text/template/parse"
+)
+
+// templateFuncs Functions available in task templates
+var templateFuncs = template.FuncMap{
+	"shellquote": shellQuote,
+	"b64encode":  func(s string) string { return base64.StdEncoding.EncodeToString([]byte(s)) },
+	"b64decode": func(s string) (string, error) {
+		decoded, err := base64.StdEncoding.DecodeString(s)
+		return string(decoded), err
+	},
+	"env":     os.Getenv,
+	"default": defaultValue,
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"add":     func(a, b any) int64 { return toInt64(a) + toInt64(b) },
+	"sub":     func(a, b any) int64 { return toInt64(a) - toInt64(b) },
+	"mul":     func(a, b any) int64 { return toInt64(a) * toInt64(b) },
+	"div": func(a, b any) (int64, error) {
+		if toInt64(b) == 0 {
+			return 0, fmt.Errorf("division by zero")
+		}
+		return toInt64(a) / toInt64(b), nil
+	},
+	"min": func(a, b any) int64 { return min(toInt64(a), toInt64(b)) },
+	"max": func(a, b any) int64 { return max(toInt64(a), toInt64(b)) },
+}
+
+// defaultValue Returns value, or def if value is empty. Used as {{ default "def" .value }}
+func defaultValue(def, value any) any {
+	if value == nil {
+		return def
+	}
+	v := reflect.ValueOf(value)
+	if v.IsZero() || ((v.Kind() == reflect.Map || v.Kind() == reflect.Slice) && v.Len() == 0) {
+		return def
+	}
+	return value
+}
+
+func toInt64(value any) int64 {
+	switch v := value.(type) {
+	case int:
+		return int64(v)
+	case int64:
+		return v
+	case float64:
+		return int64(v)
+	case string:
+		i, _ := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		return i
+	default:
+		return 0
+	}
+}
+
+// parseTemplate Missing keys are errors instead of "<no value>" in the command, optional values are read with index: {{default "60" (index .params "quality")}}
+func parseTemplate(name, text string) (*template.Template, error) {
+	return template.New(name).Funcs(templateFuncs).Option("missingkey=error").Parse(text)
+}
+
+// templateFields Returns the fields the templates read from the values, e.g. [user email] for {{.user.email}}.
+// Fields read inside {{with .user}} are prefixed with it, the ones inside {{range}} are skipped
+func templateFields(templates ...*template.Template) (fields [][]string) {
+	for _, t := range templates {
+		if t != nil && t.Tree != nil {
+			walkTemplateNode(t.Tree.Root, []string{}, &fields)
+		}
+	}
+	return
+}
+
+// walkTemplateNode Appends the fields read by node to fields. dot is the field the node is relative to, nil if unknown
+func walkTemplateNode(node parse.Node, dot []string, fields *[][]string) {
+	field := func(ident []string) {
+		if dot != nil && len(dot)+len(ident) > 0 {
+			*fields = append(*fields, append(slices.Clone(dot), ident...))
+		}
+	}
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n != nil {
+			for _, child := range n.Nodes {
+				walkTemplateNode(child, dot, fields)
+			}
+		}
+	case *parse.PipeNode:
+		if n != nil {
+			for _, cmd := range n.Cmds {
+				walkTemplateNode(cmd, dot, fields)
+			}
+		}
+	case *parse.CommandNode:
+		for _, arg := range n.Args {
+			walkTemplateNode(arg, dot, fields)
+		}
+	case *parse.ActionNode:
+		walkTemplateNode(n.Pipe, dot, fields)
+	case *parse.TemplateNode:
+		walkTemplateNode(n.Pipe, dot, fields)
+	case *parse.IfNode:
+		walkTemplateNode(n.Pipe, dot, fields)
+		walkTemplateNode(n.List, dot, fields)
+		walkTemplateNode(n.ElseList, dot, fields)
+	case *parse.RangeNode:
+		walkTemplateNode(n.Pipe, dot, fields)
+		walkTemplateNode(n.List, nil, fields)
+		walkTemplateNode(n.ElseList, dot, fields)
+	case *parse.WithNode:
+		walkTemplateNode(n.Pipe, dot, fields)
+		var inner []string
+		if with := pipeField(n.Pipe); with != nil && dot != nil {
+			inner = append(slices.Clone(dot), with.Ident...)
+		}
+		walkTemplateNode(n.List, inner, fields)
+		walkTemplateNode(n.ElseList, dot, fields)
+	case *parse.FieldNode:
+		field(n.Ident)
+	case *parse.ChainNode:
+		chained, ok := n.Node.(*parse.FieldNode)
+		if pipe, isPipe := n.Node.(*parse.PipeNode); isPipe {
+			chained = pipeField(pipe)
+			ok = chained != nil
+		}
+		if ok {
+			field(append(slices.Clone(chained.Ident), n.Field...))
+		} else {
+			walkTemplateNode(n.Node, dot, fields)
+		}
+	case *parse.VariableNode:
+		// $ is the values whatever the dot is
+		if n.Ident[0] == "$" && len(n.Ident) > 1 {
+			*fields = append(*fields, slices.Clone(n.Ident[1:]))
+		}
+	}
+}
+
+// pipeField Returns the field if the pipeline only reads one, like {{with .user}}
+func pipeField(pipe *parse.PipeNode) *parse.FieldNode {
+	if pipe == nil || len(pipe.Decl) > 0 || len(pipe.Cmds) != 1 || len(pipe.Cmds[0].Args) != 1 {
+		return nil
+	}
+	field, _ := pipe.Cmds[0].Args[0].(*parse.FieldNode)
+	return field
+}
+
+// sampleTemplateValues Placeholder values used to validate task templates, must have the same keys as TaskProcessor.templateValues.
+// Form fields depend on the client and the user fields on immich: the ones the templates read get a placeholder
+func sampleTemplateValues(task *Task, fields [][]string) map[string]any {
+	form := map[string]string{}
+	user := map[string]any{}
+	for _, field := range fields {
+		if len(field) < 2 {
+			continue
+		}
+		switch field[0] {
+		case "form":
+			form[field[1]] = "1"
+		case "user":
+			setSampleField(user, field[1:])
+		}
+	}
+	return map[string]any{
+		"result_folder":     "/result_folder",
+		"original_name":     base64.StdEncoding.EncodeToString([]byte("name.ext")),
+		"original_filename": "name.ext",
+		"folder":            "/folder",
+		"name":              "name",
+		"extension":         "ext",
+		"size":              int64(1),
+		"mime":              "application/octet-stream",
+		"width":             1,
+		"height":            1,
+		"form":              form,
+		"user":              user,
+		"params":            task.Params,
+	}
+}
+
+// setSampleField Adds a placeholder for the field, nested fields are maps
+func setSampleField(values map[string]any, field []string) {
+	if len(field) == 1 {
+		if _, ok := values[field[0]]; !ok {
+			values[field[0]] = "1"
+		}
+		return
+	}
+	child, ok := values[field[0]].(map[string]any)
+	if !ok {
+		child = map[string]any{}
+		values[field[0]] = child
+	}
+	setSampleField(child, field[1:])
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// VaultObject Describes an original stored in the vault. Expires is zero if it's kept forever
+type VaultObject struct {
+	Filename    string    `json:"filename"`
+	ContentType string    `json:"contentType"`
+	Size        int64     `json:"size"`
+	Expires     time.Time `json:"expires,omitzero"`
+}
+
+// Vault Keeps the untouched originals replaced by processed files.
+// Objects are stored under keep/<sha1> or expires/<date>/<sha1>, so expired originals can be pruned by listing a prefix
+type Vault interface {
+	// Put Stores the file, returns its location to be recorded in the checksums file
+	Put(key string, file *os.File, object VaultObject) (location string, err error)
+	// Get Opens the original at a location returned by Put
+	Get(location string) (io.ReadCloser, *VaultObject, error)
+	// Delete Removes the original at a location returned by Put
+	Delete(location string) error
+	// Prune Deletes the originals that expired before the date, returns how many were deleted
+	Prune(before time.Time) (int, error)
+}
+
+const vaultDateLayout = "2006-01-02"
+
+var vault Vault
+
+// newVault Opens the vault at a local directory or an s3://bucket/prefix URL
+func newVault(location string) (Vault, error) {
+	if strings.HasPrefix(location, "s3://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return nil, err
+		}
+		return newS3Vault(u.Host, strings.Trim(u.Path, "/"))
+	}
+	dir, err := filepath.Abs(strings.TrimPrefix(location, "file://"))
+	if err != nil {
+		return nil, err
+	}
+	if err = os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &localVault{dir: dir}, nil
+}
+
+// vaultKey Object key of an original: the SHA1 as hex, under its expiry date if it has one
+func vaultKey(checksum string, expires time.Time) (string, error) {
+	sum, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil {
+		return "", fmt.Errorf("invalid checksum %s: %w", checksum, err)
+	}
+	if expires.IsZero() {
+		return "keep/" + hex.EncodeToString(sum), nil
+	}
+	return "expires/" + expires.UTC().Format(vaultDateLayout) + "/" + hex.EncodeToString(sum), nil
+}
+
+// parseRetention Parses a task vault_retention: forever (0), none (-1), days (90d) or a Go duration (720h)
+func parseRetention(retention string) (time.Duration, error) {
+	switch retention {
+	case "", "forever":
+		return 0, nil
+	case "none":
+		return -1, nil
+	}
+	if days, ok := strings.CutSuffix(retention, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n <= 0 {
+			return 0, fmt.Errorf("invalid retention: %s", retention)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(retention)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid retention: %s", retention)
+	}
+	return d, nil
+}
+
+// archiveOriginal Stores the original in the vault before it's replaced by the processed file, returns the vault location.
+// The location is empty if there's no vault or the task retention is none
+func archiveOriginal(tp *TaskProcessor) (string, error) {
+	if vault == nil || tp.Task.vaultRetention < 0 {
+		return "", nil
+	}
+	object := VaultObject{
+		Filename:    tp.OriginalFilename,
+		ContentType: "application/octet-stream",
+		Size:        tp.OriginalSize,
+	}
+	if head, err := readFileHead(tp.tempOriginalFilePath, sniffLen); err == nil {
+		object.ContentType = detectMimeType(head)
+	}
+	if tp.Task.vaultRetention > 0 {
+		object.Expires = time.Now().Add(tp.Task.vaultRetention)
+	}
+	key, err := vaultKey(tp.OriginalHash, object.Expires)
+	if err != nil {
+		return "", err
+	}
+	location, err := vault.Put(key, tp.OriginalFile, object)
+	if err != nil {
+		return "", fmt.Errorf("unable to archive original: %w", err)
+	}
+	tp.logf("original archived: %s", location)
+	return location, nil
+}
+
+// discardArchivedOriginal Deletes an original archived for an upload that ended up sending the original, unless a record still uses it:
+// the same original uploaded before is stored at the same location
+func discardArchivedOriginal(location string, logger *customLogger) {
+	if location == "" {
+		return
+	}
+	mapLock.RLock()
+	used := slices.Contains(slices.Collect(maps.Values(fakeToVault)), location)
+	mapLock.RUnlock()
+	if used {
+		return
+	}
+	if err := vault.Delete(location); !logger.Error(err, "vault delete") {
+		logger.Printf("archived original deleted: %s", location)
+	}
+}
+
+// pruneVault Deletes expired originals now and every hour
+func pruneVault() {
+	logger := newCustomLogger(baseLogger, "")
+	logger.SetErrPrefix("vault")
+	for {
+		count, err := vault.Prune(time.Now())
+		if !logger.Error(err, "prune") && count > 0 {
+			logger.Printf("vault: pruned %d expired originals", count)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// vaultRequested Reports whether the client asked for the archived original: ?vault=true, the X-IUO-Vault header or a user listed in -vault_download_users.
+// The query parameter and header are removed, immich must not see them
+func vaultRequested(r *http.Request) bool {
+	query := r.URL.Query()
+	if value := query.Get("vault"); value != "" {
+		query.Del("vault")
+		r.URL.RawQuery = query.Encode()
+		requested, _ := strconv.ParseBool(value)
+		return requested
+	}
+	if value := r.Header.Get("X-IUO-Vault"); value != "" {
+		r.Header.Del("X-IUO-Vault")
+		requested, _ := strconv.ParseBool(value)
+		return requested
+	}
+	if vaultDownloadUsers == "" {
+		return false
+	}
+	return isVaultDownloadUser(r.Header)
+}
+
+// vaultUserTTL How long vaultUsers remembers whether the credentials belong to a -vault_download_users user
+const vaultUserTTL = time.Minute
+
+// vaultUsers Whether the user authenticated by the credentials is listed in -vault_download_users, by hash of the credentials.
+// Saves an immich request on each download
+var vaultUsers = make(map[string]vaultUser)
+var vaultUsersLock sync.Mutex
+
+type vaultUser struct {
+	listed  bool
+	expires time.Time
+}
+
+// isVaultDownloadUser Reports whether the request credentials belong to a user listed in -vault_download_users
+func isVaultDownloadUser(header http.Header) bool {
+	authHeader := immichAuthHeader(header)
+	if len(authHeader) == 0 {
+		return false
+	}
+	hash := sha256.New()
+	for _, key := range slices.Sorted(maps.Keys(authHeader)) {
+		for _, value := range authHeader[key] {
+			_, _ = fmt.Fprintf(hash, "%s: %s\n", key, value)
+		}
+	}
+	credentials := hex.EncodeToString(hash.Sum(nil))
+	now := time.Now()
+	vaultUsersLock.Lock()
+	cached, ok := vaultUsers[credentials]
+	vaultUsersLock.Unlock()
+	if ok && now.Before(cached.expires) {
+		return cached.listed
+	}
+	user, err := getImmichUser(authHeader)
+	if err != nil {
+		return false
+	}
+	users := strings.Split(vaultDownloadUsers, ",")
+	listed := slices.Contains(users, fmt.Sprint(user["email"])) || slices.Contains(users, fmt.Sprint(user["id"]))
+	vaultUsersLock.Lock()
+	defer vaultUsersLock.Unlock()
+	for key, expired := range vaultUsers {
+		if !now.Before(expired.expires) {
+			delete(vaultUsers, key)
+		}
+	}
+	vaultUsers[credentials] = vaultUser{listed, now.Add(vaultUserTTL)}
+	return listed
+}
+
+// downloadFromVault Serves the archived original of the asset instead of the stored file
+func downloadFromVault(w http.ResponseWriter, r *http.Request, logger *customLogger, assetUUID string) (err error) {
+	logger.SetErrPrefix("vault download")
+	var asset Asset
+	if asset, err = fetchAsset(r, assetUUID, logger); err != nil {
+		return
+	}
+	// Reading the asset info doesn't mean the client can download it: shared links can forbid downloads
+	var resp *http.Response
+	if resp, err = immichRequest("HEAD", r.URL.String(), r.Header, nil); logger.Error(err, "HEAD original") {
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("original download denied: HTTP %d", resp.StatusCode)
+	}
+	checksum, _ := asset["checksum"].(string)
+	mapLock.RLock()
+	location, ok := fakeToVault[checksum]
+	mapLock.RUnlock()
+	if !ok {
+		return errors.New("original not in vault")
+	}
+	var reader io.ReadCloser
+	var object *VaultObject
+	if reader, object, err = vault.Get(location); logger.Error(err, "get") {
+		return
+	}
+	defer reader.Close()
+	header := w.Header()
+	header.Set("Content-Type", object.ContentType)
+	header.Set("Cache-Control", "private, max-age=86400, no-transform")
+	header.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": object.Filename}))
+	header.Set("X-IUO-Vault", "true")
+	logger.Printf("serving original from vault: %s", location)
+	// Local originals support Range requests
+	if seeker, ok := reader.(io.ReadSeeker); ok {
+		modTime, _ := time.Parse(time.RFC3339, fmt.Sprint(asset["fileModifiedAt"]))
+		http.ServeContent(w, r, "", modTime, seeker)
+		return nil
+	}
+	header.Set("Content-Length", strconv.FormatInt(object.Size, 10))
+	w.WriteHeader(http.StatusOK)
+	if r.Method != "HEAD" {
+		_, _ = io.Copy(w, reader)
+	}
+	return nil
+}
+
+// localVault Stores originals in a directory, the object description is kept in a .json file next to it
+type localVault struct {
+	dir string
+}
+
+func (v *localVault) Put(key string, file *os.File, object VaultObject) (string, error) {
+	name := filepath.Join(v.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	// Written under a temporary name: a crash never leaves a truncated original behind a valid name
+	temp, err := os.CreateTemp(filepath.Dir(name), ".put-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(temp.Name())
+	_, err = io.Copy(temp, file)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return "", err
+	}
+	description, err := json.Marshal(object)
+	if err != nil {
+		return "", err
+	}
+	if err = os.WriteFile(name+".json", description, 0644); err != nil {
+		return "", err
+	}
+	if err = os.Rename(temp.Name(), name); err != nil {
+		return "", err
+	}
+	return name, nil
+}
+
+func (v *localVault) Get(location string) (io.ReadCloser, *VaultObject, error) {
+	if rel, err := filepath.Rel(v.dir, location); err != nil || !filepath.IsLocal(rel) {
+		return nil, nil, fmt.Errorf("%s isn't in the vault %s", location, v.dir)
+	}
+	description, err := os.ReadFile(location + ".json")
+	if err != nil {
+		return nil, nil, err
+	}
+	var object VaultObject
+	if err = json.Unmarshal(description, &object); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.Open(location)
+	if err != nil {
+		return nil, nil, err
+	}
+	return file, &object, nil
+}
+
+func (v *localVault) Delete(location string) error {
+	if rel, err := filepath.Rel(v.dir, location); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("%s isn't in the vault %s", location, v.dir)
+	}
+	if err := os.Remove(location); err != nil {
+		return err
+	}
+	return os.Remove(location + ".json")
+}
+
+func (v *localVault) Prune(before time.Time) (count int, err error) {
+	dates, err := os.ReadDir(filepath.Join(v.dir, "expires"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	today := before.UTC().Format(vaultDateLayout)
+	for _, date := range dates {
+		if !date.IsDir() || date.Name() >= today {
+			continue
+		}
+		dir := filepath.Join(v.dir, "expires", date.Name())
+		objects, _ := os.ReadDir(dir)
+		for _, object := range objects {
+			if !strings.HasSuffix(object.Name(), ".json") {
+				count++
+			}
+		}
+		if err = os.RemoveAll(dir); err != nil {
+			return count, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+const (
+	VideoCodecH264 = "h264"
+	VideoCodecAV1  = "av1"
+)
+
+// videoEncoderArgs ffmpeg video encoder settings of each download codec, 8 bit 4:2:0 plays everywhere
+var videoEncoderArgs = map[string][]string{
+	VideoCodecH264: {"-c:v", "libx264", "-preset", "veryfast", "-crf", "23", "-pix_fmt", "yuv420p"},
+	VideoCodecAV1:  {"-c:v", "libsvtav1", "-preset", "8", "-crf", "35", "-pix_fmt", "yuv420p"},
+}
+
+// videoSemaphore Limits the number of concurrent video transcodes, download transcodes don't take slots of upload tasks
+var videoSemaphore chan struct{}
+
+// videoCodecs Probed video codec by stored checksum and path, the file behind a checksum never changes
+var videoCodecs sync.Map
+
+// videoSources Requests of the videos being probed or transcoded, by the random token of their local URL
+var videoSources sync.Map
+
+// videoSourceServer Serves the stored videos to ffprobe and ffmpeg on loopback: the client credentials stay in IUO instead of their command line
+var videoSourceServer = sync.OnceValues(func() (string, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go http.Serve(listener, http.HandlerFunc(serveVideoSource))
+	return "http://" + listener.Addr().String() + "/", nil
+})
+
+// downloadAndTranscodeVideo Streams an HEVC video transcoded to downloadVideoCodec to clients that can't play HEVC.
+// The output is fragmented MP4 written while ffmpeg encodes it: it has no known length and doesn't support Range
+func downloadAndTranscodeVideo(w http.ResponseWriter, r *http.Request, logger *customLogger, assetUUID, kind string) (err error) {
+	if userAgentSupportsHEVC(r.UserAgent()) {
+		return errors.New("client supports HEVC")
+	}
+	logger.SetErrPrefix("transcode video")
+	var asset Asset
+	if asset, err = fetchAsset(r, assetUUID, logger); err != nil {
+		return
+	}
+	if asset["type"] != "VIDEO" {
+		return errors.New("not a video")
+	}
+	// The response depends on the browser, also when the video is proxied as is
+	w.Header().Add("Vary", "User-Agent")
+	var input string
+	var closeInput func()
+	if input, closeInput, err = openVideoSource(r); logger.Error(err, "video source") {
+		return
+	}
+	defer closeInput()
+	checksum, _ := asset["checksum"].(string)
+	var codec string
+	if codec, err = probeVideoCodec(r, input, checksum, kind); logger.Error(err, "ffprobe") {
+		return
+	}
+	if codec != "hevc" {
+		return errors.New("no transcoding needed: " + codec)
+	}
+	if r.Method == "HEAD" {
+		setVideoHeaders(w.Header(), asset, kind)
+		w.WriteHeader(http.StatusOK)
+		return nil
+	}
+
+	select {
+	case videoSemaphore <- struct{}{}:
+	case <-r.Context().Done():
+		return r.Context().Err()
+	}
+	defer func() { <-videoSemaphore }()
+
+	// ffmpeg is killed when the client goes away
+	cmd := exec.CommandContext(r.Context(), "ffmpeg", transcodeArgs(input)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	var stdout io.ReadCloser
+	if stdout, err = cmd.StdoutPipe(); logger.Error(err, "stdout") {
+		return
+	}
+	if err = cmd.Start(); logger.Error(err, "ffmpeg start") {
+		return
+	}
+	logger.Printf("transcoding HEVC to %s: %s", downloadVideoCodec, r.URL)
+	// Nothing is sent until ffmpeg produces output, the original can still be proxied if it fails right away
+	output := bufio.NewReaderSize(stdout, 64<<10)
+	if _, err = output.Peek(1); err != nil {
+		waitErr := cmd.Wait()
+		err = fmt.Errorf("ffmpeg: %v: %s", waitErr, strings.TrimSpace(stderr.String()))
+		logger.Error(err, "transcode")
+		return
+	}
+	setVideoHeaders(w.Header(), asset, kind)
+	w.WriteHeader(http.StatusOK)
+	written, copyErr := io.Copy(w, output)
+	if waitErr := cmd.Wait(); waitErr != nil && copyErr == nil {
+		logger.Printf("transcode failed after %s: %v: %s", humanReadableSize(written), waitErr, strings.TrimSpace(stderr.String()))
+		return nil
+	}
+	logger.Printf("transcoded: %s sent", humanReadableSize(written))
+	return nil
+}
+
+// setVideoHeaders Describes the transcoded stream, downloaded originals keep their name with the .mp4 extension appended
+func setVideoHeaders(header http.Header, asset Asset, kind string) {
+	header.Set("Content-Type", "video/mp4")
+	header.Set("Cache-Control", "private, no-store")
+	header.Set("Accept-Ranges", "none")
+	if originalFileName, ok := asset["originalFileName"].(string); ok && kind == "original" {
+		header.Set("Content-Disposition", mime.FormatMediaType("inline", map[string]string{"filename": originalFileName + ".mp4"}))
+	}
+}
+
+// probeVideoCodec Returns the codec of the first video stream, read by ffprobe from the stored file headers
+func probeVideoCodec(r *http.Request, input, checksum, kind string) (string, error) {
+	key := checksum + " " + kind
+	if codec, ok := videoCodecs.Load(key); ok && checksum != "" {
+		return codec.(string), nil
+	}
+	output, err := exec.CommandContext(r.Context(), "ffprobe", "-v", "error", "-select_streams", "v:0", "-show_entries", "stream=codec_name", "-of", "default=noprint_wrappers=1:nokey=1", input).Output()
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+	codec := strings.TrimSpace(string(output))
+	if checksum != "" {
+		videoCodecs.Store(key, codec)
+	}
+	return codec, nil
+}
+
+// transcodeArgs ffmpeg arguments to stream input as fragmented MP4 on stdout: the moov atom comes first so playback starts right away
+func transcodeArgs(input string) []string {
+	args := []string{"-nostdin", "-v", "error", "-i", input, "-map", "0:v:0", "-map", "0:a:0?"}
+	args = append(args, videoEncoderArgs[downloadVideoCodec]...)
+	return append(args, "-c:a", "aac", "-b:a", "160k", "-movflags", "frag_keyframe+empty_moov+default_base_moof", "-f", "mp4", "pipe:1")
+}
+
+// openVideoSource Returns a local URL reading the requested video from immich with the client credentials, valid until closed
+func openVideoSource(r *http.Request) (string, func(), error) {
+	base, err := videoSourceServer()
+	if err != nil {
+		return "", nil, err
+	}
+	token := rand.Text()
+	videoSources.Store(token, &http.Request{URL: r.URL, Header: immichAuthHeader(r.Header)})
+	return base + token, func() { videoSources.Delete(token) }, nil
+}
+
+// serveVideoSource Proxies the ffprobe and ffmpeg requests of an open video source to immich, Range included so they can seek
+func serveVideoSource(w http.ResponseWriter, r *http.Request) {
+	value, ok := videoSources.Load(strings.TrimPrefix(r.URL.Path, "/"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	source := value.(*http.Request)
+	req, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL+source.URL.RequestURI(), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	req.Header = source.Header.Clone()
+	// Byte ranges of the stored file, not of a compressed response
+	req.Header.Set("Accept-Encoding", "identity")
+	for _, key := range []string{"Range", "If-Range"} {
+		if value := r.Header.Get(key); value != "" {
+			req.Header.Set(key, value)
+		}
+	}
+	resp, err := getHTTPclient().Do(req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	for _, key := range []string{"Content-Type", "Content-Length", "Content-Range", "Accept-Ranges"} {
+		if value := resp.Header.Get(key); value != "" {
+			w.Header().Set(key, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
@@ -45,7 +45,7 @@ func (wsMsg WebSocket42) getUploadReadyAsset() Asset {
 	return nil
 }
 
-func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger) {
+func handleWebSocketConn(cliConn, srvConn *websocket.Conn, header http.Header, logger *customLogger) {
 	var wg sync.WaitGroup
 	wg.Add(2)
 	logger.SetErrPrefix("websocket proxy")
@@ -70,10 +70,14 @@ func handleWebSocketConn(cliConn, srvConn *websocket.Conn, logger *customLogger)
 					asset = wsMsg.getUploadSuccessAsset()
 				case "AssetUploadReadyV1":
 					asset = wsMsg.getUploadReadyAsset()
+				case "on_asset_delete":
+					if id, ok := wsMsg[1].(string); ok && checksumsGCGrace > 0 {
+						observeDeletedAssets([]string{id}, logger)
+					}
 				}
 				if asset != nil {
 					mapLock.RLock()
-					asset.toOriginalAsset()
+					asset.toOriginalAsset(header)
 					mapLock.RUnlock()
 					if message, err = json.Marshal(wsMsg); logger.Error(err, "json encode") {
 						continue
@@ -130,5 +134,5 @@ func upgradeWebSocketRequest(w http.ResponseWriter, r *http.Request, logger *cus
 		return
 	}
 	defer srvConn.Close()
-	handleWebSocketConn(cliConn, srvConn, logger)
+	handleWebSocketConn(cliConn, srvConn, r.Header, logger)
 }